@@ -1,6 +1,19 @@
 package btree
 
+import "context"
+
+// Get returns ErrNotFound for a missing key, a stored empty value is returned as an empty slice
 type IBTree interface {
 	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
 	Put(key, value []byte) error
+	// same as above, but abort between page loads once ctx is done
+	GetContext(ctx context.Context, key []byte) ([]byte, error)
+	PutContext(ctx context.Context, key, value []byte) error
+}
+
+// ordered iteration over keys from [start, end), nil bounds are open, fn returns false to stop
+type IScanner interface {
+	Scan(start, end []byte, fn func(key, value []byte) bool) error
+	ScanContext(ctx context.Context, start, end []byte, fn func(key, value []byte) bool) error
 }
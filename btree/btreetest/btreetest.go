@@ -0,0 +1,403 @@
+/*
+Package btreetest is a conformance suite for btree.IBTree implementations.
+
+Run executes a standard battery of tests against trees produced by a factory, every test gets
+its own path and a random source seeded from TConfig.Seed, the BTREETEST_SEED environment variable
+or the current time. The seed is logged, so a failure can be reproduced by setting the variable.
+*/
+package btreetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/util"
+)
+
+/******************* PUBLIC *******************/
+const SeedEnv = "BTREETEST_SEED"
+
+type TCapabilities uint32
+
+const (
+	Persistence TCapabilities = 1 << iota // data survives closing and opening the tree at the same path
+	Concurrency                           // methods may be called from several goroutines at once
+)
+
+// opens the tree stored at path or creates it, close releases the tree and everything it holds
+type TFactory func(path string) (tree btree.IBTree, close func() error, err error)
+
+// optional, trees implementing it are checked for deletes as well
+type IDeleter interface {
+	Delete(key []byte) error
+}
+
+type TConfig struct {
+	Lacks        TCapabilities // tests of these capabilities are skipped
+	Seed         int64         // 0 means SeedEnv or the current time
+	MaxKeySize   int           // the largest key stored together with a value of MaxValueSize, 16 by default
+	MaxValueSize int           // 64 by default
+	Operations   int           // operations of the randomized comparison with a reference model, 2000 by default
+}
+
+func Run(t *testing.T, factory TFactory, config TConfig) {
+	config, err := withDefaults(config)
+	require.Empty(t, err)
+	t.Logf("seed [%v], set %v=%v to reproduce", config.Seed, SeedEnv, config.Seed)
+	s := &tSuite{factory: factory, config: config}
+	t.Run("Ordering", s.testOrdering)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("MissingAndEmpty", s.testMissingAndEmpty)
+	t.Run("Reopen", s.testReopen)
+	t.Run("Concurrency", s.testConcurrency)
+	t.Run("LargeTuples", s.testLargeTuples)
+	t.Run("Differential", s.testDifferential)
+}
+
+/******************* PRIVATE *******************/
+type tSuite struct {
+	factory TFactory
+	config  TConfig
+}
+
+type tOpenTree struct {
+	tree  btree.IBTree
+	close func() error
+}
+
+func withDefaults(config TConfig) (TConfig, error) {
+	if config.Seed == 0 {
+		if env := os.Getenv(SeedEnv); env != "" {
+			seed, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				return config, fmt.Errorf("invalid seed [%v], error [%w]", env, err)
+			}
+			config.Seed = seed
+		} else {
+			config.Seed = time.Now().UnixNano()
+		}
+	}
+	if config.MaxKeySize == 0 {
+		config.MaxKeySize = 16
+	}
+	if config.MaxValueSize == 0 {
+		config.MaxValueSize = 64
+	}
+	if config.Operations == 0 {
+		config.Operations = 2000
+	}
+	return config, nil
+}
+
+// opens a tree at a fresh path, which is removed together with the tree when the test ends
+func (s *tSuite) open(t *testing.T) (*tOpenTree, string) {
+	path := "./" + util.TimeBasedFileName()
+	t.Cleanup(func() { os.Remove(path) })
+	return s.reopen(t, path), path
+}
+
+func (s *tSuite) reopen(t *testing.T, path string) *tOpenTree {
+	tree, close, err := s.factory(path)
+	require.Empty(t, err)
+	require.NotEmpty(t, tree)
+	opened := &tOpenTree{tree: tree, close: close}
+	t.Cleanup(func() { opened.release(t) })
+	return opened
+}
+
+func (o *tOpenTree) release(t *testing.T) {
+	if o.close == nil {
+		return
+	}
+	close := o.close
+	o.close = nil
+	require.Empty(t, close())
+}
+
+func (s *tSuite) rand() *rand.Rand {
+	return rand.New(rand.NewSource(s.config.Seed))
+}
+
+func (s *tSuite) skipIfLacks(t *testing.T, capability TCapabilities, name string) {
+	if s.config.Lacks&capability != 0 {
+		t.Skipf("implementation lacks %v", name)
+	}
+}
+
+func (s *tSuite) testOrdering(t *testing.T) {
+	opened, _ := s.open(t)
+	keys := [][]byte{
+		[]byte("\x00"), []byte("\x00\x00"), []byte("a"), []byte("a\x00"), []byte("aa"),
+		[]byte("ab"), []byte("b"), []byte("\x7f"), []byte("\x80"), []byte("\xff"), []byte("\xff\xff"),
+	}
+	rng := s.rand()
+	for i := 0; i < 300; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%v-%v", rng.Intn(1000000), i)))
+	}
+	shuffled := append([][]byte{}, keys...)
+	rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	model := map[string][]byte{}
+	for i, key := range shuffled {
+		value := []byte(fmt.Sprintf("value%v", i))
+		require.Empty(t, opened.tree.Put(key, value), "key [%q]", key)
+		model[string(key)] = value
+	}
+	checkModel(t, opened.tree, model)
+	scanner, ok := opened.tree.(btree.IScanner)
+	if !ok {
+		return
+	}
+	lo, hi := []byte("a"), []byte("b")
+	expected := [][]byte{}
+	for _, key := range sortedKeys(model) {
+		if bytes.Compare(key, lo) >= 0 && bytes.Compare(key, hi) < 0 {
+			expected = append(expected, key)
+		}
+	}
+	actual := [][]byte{}
+	require.Empty(t, scanner.Scan(lo, hi, func(key, value []byte) bool {
+		actual = append(actual, append([]byte{}, key...))
+		return true
+	}))
+	require.Equal(t, expected, actual)
+}
+
+func (s *tSuite) testOverwrite(t *testing.T) {
+	opened, _ := s.open(t)
+	key := []byte("key")
+	values := [][]byte{[]byte("first"), []byte("a much longer second value"), {}, []byte("x")}
+	for _, value := range values {
+		require.Empty(t, opened.tree.Put(key, value))
+		actual, err := opened.tree.Get(key)
+		require.Empty(t, err)
+		require.Equal(t, value, actual)
+	}
+	model := map[string][]byte{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			model[key] = bytes.Repeat([]byte{byte('a' + round)}, (i*7+round)%(s.config.MaxValueSize+1))
+			require.Empty(t, opened.tree.Put([]byte(key), model[key]))
+		}
+	}
+	checkModel(t, opened.tree, model)
+}
+
+func (s *tSuite) testMissingAndEmpty(t *testing.T) {
+	opened, _ := s.open(t)
+	_, err := opened.tree.Get([]byte("missing"))
+	require.ErrorIs(t, err, btree.ErrNotFound)
+	require.Empty(t, opened.tree.Put([]byte("empty"), []byte{}))
+	require.Empty(t, opened.tree.Put([]byte("nil"), nil))
+	for _, key := range []string{"empty", "nil"} {
+		value, err := opened.tree.Get([]byte(key))
+		require.Empty(t, err)
+		require.NotNil(t, value)
+		require.Empty(t, value)
+		has, err := opened.tree.Has([]byte(key))
+		require.Empty(t, err)
+		require.True(t, has)
+	}
+	has, err := opened.tree.Has([]byte("missing"))
+	require.Empty(t, err)
+	require.False(t, has)
+}
+
+func (s *tSuite) testReopen(t *testing.T) {
+	s.skipIfLacks(t, Persistence, "persistence")
+	opened, path := s.open(t)
+	model := map[string][]byte{}
+	rng := s.rand()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%v", rng.Intn(400))
+			model[key] = randomBytes(rng, rng.Intn(s.config.MaxValueSize+1))
+			require.Empty(t, opened.tree.Put([]byte(key), model[key]))
+		}
+		opened.release(t)
+		opened = s.reopen(t, path)
+		checkModel(t, opened.tree, model)
+	}
+}
+
+func (s *tSuite) testConcurrency(t *testing.T) {
+	s.skipIfLacks(t, Concurrency, "concurrency")
+	opened, _ := s.open(t)
+	writers, keysPerWriter := 4, 200
+	preloaded := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("preloaded%03d", i)
+		preloaded[key] = []byte(key)
+		require.Empty(t, opened.tree.Put([]byte(key), preloaded[key]))
+	}
+	errs := make(chan error, writers+1)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				key := []byte(fmt.Sprintf("writer%v-%03d", w, i))
+				if err := opened.tree.Put(key, key); err != nil {
+					errs <- err
+					return
+				}
+				if value, err := opened.tree.Get(key); err != nil || !bytes.Equal(key, value) {
+					errs <- fmt.Errorf("read [%q] with error [%v] after writing [%q]", value, err, key)
+					return
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			for key, expected := range preloaded {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if value, err := opened.tree.Get([]byte(key)); err != nil || !bytes.Equal(expected, value) {
+					errs <- fmt.Errorf("read [%q] with error [%v] instead of [%q]", value, err, expected)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-readerDone
+	close(errs)
+	for err := range errs {
+		require.Empty(t, err)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			key := fmt.Sprintf("writer%v-%03d", w, i)
+			preloaded[key] = []byte(key)
+		}
+	}
+	checkModel(t, opened.tree, preloaded)
+}
+
+// tuples up to the configured limits are stored, larger ones are either stored or rejected without damage
+func (s *tSuite) testLargeTuples(t *testing.T) {
+	opened, _ := s.open(t)
+	rng := s.rand()
+	model := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		prefix := fmt.Sprintf("%03d", i)
+		key := append([]byte(prefix), randomBytes(rng, s.config.MaxKeySize-len(prefix))...)
+		model[string(key)] = randomBytes(rng, s.config.MaxValueSize)
+		require.Empty(t, opened.tree.Put(key, model[string(key)]))
+	}
+	checkModel(t, opened.tree, model)
+	huge := randomBytes(rng, 1<<20)
+	oversized := []struct{ key, value []byte }{
+		{[]byte("huge value"), huge},
+		{huge, []byte("value of a huge key")},
+	}
+	for _, tuple := range oversized {
+		err := opened.tree.Put(tuple.key, tuple.value)
+		if err == nil {
+			model[string(tuple.key)] = tuple.value
+			continue
+		}
+		if !errors.Is(err, btree.ErrKeyTooLarge) && !errors.Is(err, btree.ErrValueTooLarge) {
+			require.Fail(t, "unexpected error for an oversized tuple", "error [%v]", err)
+		}
+		_, err = opened.tree.Get(tuple.key)
+		require.ErrorIs(t, err, btree.ErrNotFound)
+	}
+	checkModel(t, opened.tree, model)
+}
+
+// random operations compared against a map, persistent trees are reopened in between
+func (s *tSuite) testDifferential(t *testing.T) {
+	opened, path := s.open(t)
+	rng := s.rand()
+	model := map[string][]byte{}
+	keySpace := s.config.Operations/2 + 1
+	for op := 0; op < s.config.Operations; op++ {
+		key := []byte(fmt.Sprintf("k%v", rng.Intn(keySpace)))
+		expected, exists := model[string(key)]
+		switch choice := rng.Intn(10); {
+		case choice < 5:
+			value := randomBytes(rng, rng.Intn(s.config.MaxValueSize+1))
+			require.Empty(t, opened.tree.Put(key, value), "op [%v]", op)
+			model[string(key)] = value
+		case choice < 7:
+			value, err := opened.tree.Get(key)
+			if exists {
+				require.Empty(t, err, "op [%v]", op)
+				require.Equal(t, expected, value, "op [%v]", op)
+			} else {
+				require.ErrorIs(t, err, btree.ErrNotFound, "op [%v]", op)
+			}
+		case choice < 8:
+			has, err := opened.tree.Has(key)
+			require.Empty(t, err, "op [%v]", op)
+			require.Equal(t, exists, has, "op [%v]", op)
+		default:
+			deleter, ok := opened.tree.(IDeleter)
+			if !ok {
+				continue
+			}
+			require.Empty(t, deleter.Delete(key), "op [%v]", op)
+			delete(model, string(key))
+		}
+		if s.config.Lacks&Persistence == 0 && (op+1)%(s.config.Operations/4+1) == 0 {
+			opened.release(t)
+			opened = s.reopen(t, path)
+		}
+	}
+	checkModel(t, opened.tree, model)
+	scanner, ok := opened.tree.(btree.IScanner)
+	if !ok {
+		return
+	}
+	expected := sortedKeys(model)
+	actual := [][]byte{}
+	require.Empty(t, scanner.Scan(nil, nil, func(key, value []byte) bool {
+		actual = append(actual, append([]byte{}, key...))
+		require.Equal(t, model[string(key)], value)
+		return true
+	}))
+	require.Equal(t, expected, actual)
+}
+
+func checkModel(t *testing.T, tree btree.IBTree, model map[string][]byte) {
+	for key, expected := range model {
+		value, err := tree.Get([]byte(key))
+		require.Empty(t, err, "key [%q]", key)
+		require.Equal(t, expected, value, "key [%q]", key)
+	}
+}
+
+func sortedKeys(model map[string][]byte) [][]byte {
+	keys := make([][]byte, 0, len(model))
+	for key := range model {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+func randomBytes(rng *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	rng.Read(data)
+	return data
+}
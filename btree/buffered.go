@@ -0,0 +1,311 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/vladem/btree/storage"
+)
+
+/*
+Write-optimized tree (B-epsilon tree). Internal nodes keep pivots in a part of the page and use
+the rest of it as a buffer of pending messages (puts and deletes). Modifications are added to the buffer
+of the root and, when a buffer fills, the messages of the child with the most pending bytes are flushed
+to it in one batch. Requires a node storage without a fixed cells count.
+*/
+type TBufferedBTree struct {
+	nodeStorage storage.INodeStorage
+	mutex       *sync.Mutex
+}
+
+// share of a page which pivots of an internal node may occupy, the rest is reserved for the buffer
+const bufferedPivotShare = 0.5
+
+/******************* PUBLIC *******************/
+func (t *TBufferedBTree) Get(target []byte) ([]byte, error) {
+	return t.GetContext(context.Background(), target)
+}
+
+func (t *TBufferedBTree) GetContext(ctx context.Context, target []byte) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	node := t.nodeStorage.RootNode()
+	for !node.IsLeaf() {
+		// messages of upper nodes are newer than everything below them
+		if idx, found := searchMessages(node, target); found {
+			message := node.Message(idx)
+			if message.Kind == storage.MessageDelete {
+				return nil, ErrNotFound
+			}
+			return message.Value, nil
+		}
+		idx, found := node.Search(target)
+		if found {
+			idx += 1
+		}
+		var err error
+		node, err = t.nodeStorage.LoadNodeContext(ctx, node.Child(idx))
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx, found := node.Search(target)
+	if !found {
+		return nil, ErrNotFound
+	}
+	return node.Value(idx), nil
+}
+
+func (t *TBufferedBTree) Has(key []byte) (bool, error) {
+	_, err := t.Get(key)
+	return found(err)
+}
+
+func (t *TBufferedBTree) Put(key, value []byte) error {
+	return t.PutContext(context.Background(), key, value)
+}
+
+// either succeeds or leaves the tree intact, a put cancelled between page loads is rolled back
+func (t *TBufferedBTree) PutContext(ctx context.Context, key, value []byte) error {
+	if err := checkTupleSize(t.nodeStorage.Config(), key, value); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return t.apply(ctx, storage.TMessage{Kind: storage.MessagePut, Key: key, Value: value})
+}
+
+func (t *TBufferedBTree) Delete(key []byte) error {
+	return t.DeleteContext(context.Background(), key)
+}
+
+func (t *TBufferedBTree) DeleteContext(ctx context.Context, key []byte) error {
+	if err := checkTupleSize(t.nodeStorage.Config(), key, nil); err != nil {
+		return err
+	}
+	return t.apply(ctx, storage.TMessage{Kind: storage.MessageDelete, Key: key})
+}
+
+func MakeBufferedBTree(nodeStorage storage.INodeStorage) *TBufferedBTree {
+	config := nodeStorage.Config()
+	if config.MaxCellsCount != 0 || config.ComparatorId != storage.ComparatorBytewise {
+		return nil
+	}
+	return &TBufferedBTree{nodeStorage: nodeStorage, mutex: &sync.Mutex{}}
+}
+
+/******************* PRIVATE *******************/
+// node produced by a split, pivot separates it from the previous piece and is nil for the first one
+type tPiece struct {
+	pivot []byte
+	node  storage.INode
+}
+
+// messages of other goroutines may share the sync, so it is waited for without holding the tree
+func (t *TBufferedBTree) apply(ctx context.Context, message storage.TMessage) error {
+	if err := t.applyAtomically(ctx, message); err != nil {
+		return err
+	}
+	return t.nodeStorage.WaitDurable()
+}
+
+func (t *TBufferedBTree) applyAtomically(ctx context.Context, message storage.TMessage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.nodeStorage.Begin(); err != nil {
+		return err
+	}
+	if err := t.applyToRoot(ctx, message); err != nil {
+		return rollback(t.nodeStorage, err)
+	}
+	if err := t.nodeStorage.Commit(); err != nil {
+		return rollback(t.nodeStorage, err)
+	}
+	return nil
+}
+
+func (t *TBufferedBTree) applyToRoot(ctx context.Context, message storage.TMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	root := t.nodeStorage.RootNode()
+	var (
+		pieces []tPiece
+		err    error
+	)
+	if root.IsLeaf() {
+		pieces, err = t.applyToLeaf(root, []storage.TMessage{message})
+	} else {
+		addMessage(root, message)
+		pieces, err = t.settle(ctx, root)
+	}
+	if err != nil || len(pieces) == 1 {
+		return err
+	}
+	newRoot, err := t.nodeStorage.AllocateRootNode()
+	if err != nil {
+		return err
+	}
+	insertPieces(newRoot, 0, pieces)
+	return newRoot.Save()
+}
+
+// flushes the buffer of an internal node until it fits into a page, then splits it if pivots exceed their share
+func (t *TBufferedBTree) settle(ctx context.Context, node storage.INode) ([]tPiece, error) {
+	pageSize := t.nodeStorage.Config().NodeSizeBytes()
+	for node.UsedBytes() > pageSize && node.MessageCount() > 0 {
+		childIdx, messages := takeHeaviestBatch(node)
+		child, err := t.nodeStorage.LoadNodeContext(ctx, node.Child(childIdx))
+		if err != nil {
+			return nil, err
+		}
+		var pieces []tPiece
+		if child.IsLeaf() {
+			pieces, err = t.applyToLeaf(child, messages)
+		} else {
+			for _, message := range messages {
+				addMessage(child, message)
+			}
+			pieces, err = t.settle(ctx, child)
+		}
+		if err != nil {
+			return nil, err
+		}
+		insertPieces(node, childIdx, pieces)
+	}
+	maxPivotBytes := uint32(float64(pageSize) * bufferedPivotShare)
+	return splitPieces(node, func(node storage.INode) bool {
+		return node.UsedBytes()-messagesBytes(node) > maxPivotBytes
+	})
+}
+
+func (t *TBufferedBTree) applyToLeaf(leaf storage.INode, messages []storage.TMessage) ([]tPiece, error) {
+	for _, message := range messages {
+		idx, found := leaf.Search(message.Key)
+		if message.Kind == storage.MessageDelete {
+			if found {
+				leaf.RemoveKeyValue(idx)
+			}
+		} else if found {
+			leaf.UpdateValue(idx, message.Value)
+		} else {
+			leaf.InsertKeyValue(message.Key, message.Value, idx)
+		}
+	}
+	pageSize := t.nodeStorage.Config().NodeSizeBytes()
+	return splitPieces(leaf, func(node storage.INode) bool {
+		return node.UsedBytes() > pageSize
+	})
+}
+
+// splits the node in halves until no piece is too big, saves all pieces
+func splitPieces(node storage.INode, tooBig func(storage.INode) bool) ([]tPiece, error) {
+	pieces := []tPiece{{node: node}}
+	for i := 0; i < len(pieces); {
+		lhs := pieces[i].node
+		if !tooBig(lhs) {
+			i++
+			continue
+		}
+		rhs, err := lhs.SplitAt(byteSplitIdx(lhs, 0.5))
+		if err != nil {
+			return nil, err
+		}
+		pivot, err := rhs.KeyFull(0)
+		if err != nil {
+			return nil, err
+		}
+		for lhs.MessageCount() > 0 {
+			last := lhs.MessageCount() - 1
+			message := lhs.Message(last)
+			if bytes.Compare(message.Key, pivot) == -1 {
+				break
+			}
+			rhs.InsertMessage(message, 0)
+			lhs.RemoveMessage(last)
+		}
+		pieces = append(pieces[:i+1], append([]tPiece{{pivot: pivot, node: rhs}}, pieces[i+1:]...)...)
+	}
+	for _, piece := range pieces {
+		if err := piece.node.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return pieces, nil
+}
+
+// pieces replace the child with index childIdx
+func insertPieces(parent storage.INode, childIdx int, pieces []tPiece) {
+	for i := 1; i < len(pieces); i++ {
+		parent.InsertKey(pieces[i].pivot, childIdx+i-1)
+		parent.InsertChild(pieces[i].node.Id(), childIdx+i)
+	}
+}
+
+// removes and returns messages addressed to the child which has the most pending bytes
+func takeHeaviestBatch(node storage.INode) (int, []storage.TMessage) {
+	routes := make([]int, node.MessageCount())
+	weights := make([]uint32, node.KeyCount()+1)
+	for i := range routes {
+		routes[i] = sort.Search(node.KeyCount(), func(j int) bool {
+			key, _ := node.KeyFull(j)
+			return bytes.Compare(node.Message(i).Key, key) == -1
+		})
+		weights[routes[i]] += node.MessageSize(i)
+	}
+	heaviest := 0
+	for i, weight := range weights {
+		if weight > weights[heaviest] {
+			heaviest = i
+		}
+	}
+	messages := []storage.TMessage{}
+	for i := len(routes) - 1; i >= 0; i-- {
+		if routes[i] == heaviest {
+			messages = append([]storage.TMessage{node.Message(i)}, messages...)
+			node.RemoveMessage(i)
+		}
+	}
+	return heaviest, messages
+}
+
+// a newer message for the same key replaces the older one
+func addMessage(node storage.INode, message storage.TMessage) {
+	idx, found := searchMessages(node, message.Key)
+	if found {
+		node.RemoveMessage(idx)
+	}
+	node.InsertMessage(message, idx)
+}
+
+func searchMessages(node storage.INode, key []byte) (int, bool) {
+	idx := sort.Search(node.MessageCount(), func(i int) bool {
+		return bytes.Compare(node.Message(i).Key, key) != -1
+	})
+	return idx, idx < node.MessageCount() && bytes.Equal(node.Message(idx).Key, key)
+}
+
+func messagesBytes(node storage.INode) uint32 {
+	if node.MessageCount() == 0 {
+		return 0
+	}
+	total := uint32(4)
+	for i := 0; i < node.MessageCount(); i++ {
+		total += node.MessageSize(i)
+	}
+	return total
+}
+
+func checkTupleSize(config storage.TConfig, key, value []byte) error {
+	if uint32(4+len(key)) > config.MaxTupleSize(false) {
+		return fmt.Errorf("%w: key size [%v] exceeds the limit", ErrKeyTooLarge, len(key))
+	}
+	if uint32(4+len(key)+len(value)) > config.MaxTupleSize(true) {
+		return fmt.Errorf("%w: value size [%v] exceeds the limit", ErrValueTooLarge, len(value))
+	}
+	return nil
+}
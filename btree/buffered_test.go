@@ -0,0 +1,142 @@
+package btree_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
+)
+
+func makeBufferedTree(t *testing.T, filePath string) (*btree.TBufferedBTree, storage.INodeStorage) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakeBufferedBTree(strg)
+	require.NotEmpty(t, tree)
+	return tree, strg
+}
+
+func TestBufferedPutAndGet(t *testing.T) {
+	keys, values := manyKeys(2000)
+	util.ShuffleSliceBytes(keys)
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	tree, strg := makeBufferedTree(t, filePath)
+	defer strg.Close()
+	for i, key := range keys {
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.Empty(t, err)
+		require.Equal(t, values[i], val)
+	}
+	_, err := tree.Get([]byte("missing"))
+	require.ErrorIs(t, err, btree.ErrNotFound)
+}
+
+func TestBufferedRandomOperations(t *testing.T) {
+	seed := rand.Int63()
+	t.Logf("seed [%v]", seed)
+	r := rand.New(rand.NewSource(seed))
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	tree, strg := makeBufferedTree(t, filePath)
+	expected := map[string][]byte{}
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", r.Intn(1500)))
+		if r.Intn(4) == 0 {
+			require.Empty(t, tree.Delete(key))
+			delete(expected, string(key))
+			continue
+		}
+		value := bytes.Repeat([]byte{byte('a' + r.Intn(26))}, r.Intn(100))
+		require.Empty(t, tree.Put(key, value))
+		expected[string(key)] = value
+	}
+	check := func() {
+		for i := 0; i < 1500; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			val, err := tree.Get(key)
+			if _, ok := expected[string(key)]; !ok {
+				require.ErrorIs(t, err, btree.ErrNotFound, "key [%s]", key)
+				continue
+			}
+			require.Empty(t, err)
+			require.Equal(t, expected[string(key)], val, "key [%s]", key)
+		}
+	}
+	check()
+	require.Empty(t, strg.Close())
+
+	tree, strg = makeBufferedTree(t, filePath)
+	defer strg.Close()
+	check()
+}
+
+// puts are buffered in the root, so they do not load a root-to-leaf path each time
+func TestBufferedPutsSkipDescent(t *testing.T) {
+	keys, values := manyKeys(3000)
+	r := rand.New(rand.NewSource(1))
+	r.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	readCalls := func(put func(storage.INodeStorage, []byte, []byte) error) uint64 {
+		filePath := "./" + util.TimeBasedFileName()
+		defer os.Remove(filePath)
+		strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath})
+		require.Empty(t, err)
+		defer strg.Close()
+		for i, key := range keys {
+			require.Empty(t, put(strg, key, values[i]))
+		}
+		return strg.Statistics().ReadCalls
+	}
+	var paged *btree.TPagedBTree
+	pagedCalls := readCalls(func(strg storage.INodeStorage, key, value []byte) error {
+		if paged == nil {
+			paged = btree.MakePagedBTree(strg, 0)
+		}
+		return paged.Put(key, value)
+	})
+	var buffered *btree.TBufferedBTree
+	bufferedCalls := readCalls(func(strg storage.INodeStorage, key, value []byte) error {
+		if buffered == nil {
+			buffered = btree.MakeBufferedBTree(strg)
+		}
+		return buffered.Put(key, value)
+	})
+	require.Less(t, bufferedCalls, pagedCalls)
+}
+
+func TestBufferedRequiresVariableCells(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 5})
+	require.Empty(t, err)
+	defer strg.Close()
+	require.Empty(t, btree.MakeBufferedBTree(strg))
+}
+
+func TestPagedRejectsBufferedFile(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	tree, strg := makeBufferedTree(t, filePath)
+	keys, values := manyKeys(200)
+	for i, key := range keys {
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	strg.Close()
+
+	strg, err := storage.MakeNodeStorage(storage.TConfig{FilePath: filePath})
+	require.Empty(t, err)
+	defer strg.Close()
+	require.Empty(t, btree.MakePagedBTree(strg, 0))
+	require.NotEmpty(t, btree.MakeBufferedBTree(strg))
+}
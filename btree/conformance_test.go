@@ -0,0 +1,63 @@
+package btree_test
+
+import (
+	"testing"
+
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/btree/btreetest"
+	"github.com/vladem/btree/storage"
+)
+
+func pagedFactory(storageConfig storage.TConfig, treeConfig btree.TConfig) btreetest.TFactory {
+	return func(path string) (btree.IBTree, func() error, error) {
+		storageConfig.FilePath = path
+		strg, err := storage.MakeNodeStorage(storageConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		return btree.MakePagedBTreeWithConfig(strg, treeConfig), strg.Close, nil
+	}
+}
+
+func TestConformanceDummy(t *testing.T) {
+	factory := func(path string) (btree.IBTree, func() error, error) {
+		return btree.MakeDummyBTree(), nil, nil
+	}
+	btreetest.Run(t, factory, btreetest.TConfig{Lacks: btreetest.Persistence})
+}
+
+func TestConformancePagedFixed(t *testing.T) {
+	storageConfig := storage.TConfig{PageSizeBytes: 1024, MaxCellsCount: 5}
+	btreetest.Run(t, pagedFactory(storageConfig, btree.TConfig{MaxKeysCount: 5}), btreetest.TConfig{MaxKeySize: 32, MaxValueSize: 100})
+}
+
+func TestConformancePagedByteBudget(t *testing.T) {
+	storageConfig := storage.TConfig{PageSizeBytes: 1024}
+	treeConfig := btree.TConfig{Redistribute: true, AppendFastPath: true}
+	btreetest.Run(t, pagedFactory(storageConfig, treeConfig), btreetest.TConfig{MaxKeySize: 64, MaxValueSize: 150})
+}
+
+func bufferedFactory(storageConfig storage.TConfig) btreetest.TFactory {
+	return func(path string) (btree.IBTree, func() error, error) {
+		storageConfig.FilePath = path
+		strg, err := storage.MakeNodeStorage(storageConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		return btree.MakeBufferedBTree(strg), strg.Close, nil
+	}
+}
+
+func TestConformanceBuffered(t *testing.T) {
+	btreetest.Run(t, bufferedFactory(storage.TConfig{PageSizeBytes: 1024}), btreetest.TConfig{MaxKeySize: 32, MaxValueSize: 100})
+}
+
+func TestConformancePagedBufferPool(t *testing.T) {
+	storageConfig := storage.TConfig{PageSizeBytes: 512, BufferPoolBytes: 512 * 8}
+	btreetest.Run(t, pagedFactory(storageConfig, btree.TConfig{AppendFastPath: true}), btreetest.TConfig{MaxKeySize: 32, MaxValueSize: 64})
+}
+
+func TestConformanceBufferedBufferPool(t *testing.T) {
+	storageConfig := storage.TConfig{PageSizeBytes: 1024, BufferPoolBytes: 1024 * 8}
+	btreetest.Run(t, bufferedFactory(storageConfig), btreetest.TConfig{MaxKeySize: 32, MaxValueSize: 100})
+}
@@ -1,6 +1,11 @@
 package btree
 
-import "sync"
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+)
 
 // not really a btree
 type TDummyBTree struct {
@@ -9,21 +14,68 @@ type TDummyBTree struct {
 }
 
 func (bt *TDummyBTree) Get(key []byte) ([]byte, error) {
+	return bt.GetContext(context.Background(), key)
+}
+
+func (bt *TDummyBTree) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	bt.mutex.RLock()
 	defer bt.mutex.RUnlock()
 	if val, ok := bt.data[string(key)]; ok {
 		return val, nil
 	}
-	return nil, nil
+	return nil, ErrNotFound
+}
+
+func (bt *TDummyBTree) Has(key []byte) (bool, error) {
+	_, err := bt.Get(key)
+	return found(err)
 }
 
 func (bt *TDummyBTree) Put(key, value []byte) error {
+	return bt.PutContext(context.Background(), key, value)
+}
+
+func (bt *TDummyBTree) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	bt.mutex.Lock()
 	defer bt.mutex.Unlock()
+	if value == nil {
+		value = []byte{}
+	}
 	bt.data[string(key)] = value
 	return nil
 }
 
+func (bt *TDummyBTree) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	return bt.ScanContext(context.Background(), start, end, fn)
+}
+
+func (bt *TDummyBTree) ScanContext(ctx context.Context, start, end []byte, fn func(key, value []byte) bool) error {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+	keys := []string{}
+	for key := range bt.data {
+		if (start == nil || bytes.Compare([]byte(key), start) != -1) && (end == nil || bytes.Compare([]byte(key), end) == -1) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn([]byte(key), bt.data[key]) {
+			break
+		}
+	}
+	return nil
+}
+
 func MakeDummyBTree() *TDummyBTree {
 	return &TDummyBTree{data: make(map[string][]byte), mutex: &sync.RWMutex{}}
 }
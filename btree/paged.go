@@ -1,6 +1,10 @@
 package btree
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 
@@ -11,66 +15,156 @@ const chunkSize = 1024
 
 /******************* PUBLIC *******************/
 func (t *TPagedBTree) Get(target []byte) ([]byte, error) {
+	return t.GetContext(context.Background(), target)
+}
+
+func (t *TPagedBTree) GetContext(ctx context.Context, target []byte) ([]byte, error) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	node := t.nodeStorage.RootNode()
-	for {
-		if node.IsLeaf() {
-			break
-		}
-		var i int
-		for i = 0; i < node.KeyCount(); i++ {
-			rel, err := compare(target, node.Key(i), chunkSize)
-			if err != nil {
-				return nil, err
-			}
-			if rel == -1 {
-				break
-			}
+	for !node.IsLeaf() {
+		// child i holds keys less than key i
+		i, found := node.Search(target)
+		if found {
+			i += 1
 		}
 		var err error
-		node, err = t.nodeStorage.LoadNode(node.Child(i))
+		node, err = t.nodeStorage.LoadNodeContext(ctx, node.Child(i))
 		if err != nil {
 			return nil, err
 		}
 	}
-	for i := 0; i < node.KeyCount(); i++ {
-		rel, err := compare(target, node.Key(i), chunkSize)
-		if err != nil {
-			return nil, err
-		}
-		if rel == 0 {
-			return node.Value(i), nil
-		}
+	if i, found := node.Search(target); found {
+		return node.Value(i), nil
 	}
-	return nil, nil
+	return nil, ErrNotFound
+}
+
+func (t *TPagedBTree) Has(key []byte) (bool, error) {
+	_, err := t.Get(key)
+	return found(err)
 }
 
 func (t *TPagedBTree) Put(key, value []byte) error {
+	return t.PutContext(context.Background(), key, value)
+}
+
+/*
+Either succeeds or leaves the tree intact, a put cancelled between page loads is rolled back.
+Returns once the put is as durable as the policy of the storage makes it.
+*/
+func (t *TPagedBTree) PutContext(ctx context.Context, key, value []byte) error {
+	if err := t.putAtomically(ctx, key, value); err != nil {
+		return err
+	}
+	// puts of other goroutines may share the sync, so it is waited for without holding the tree
+	return t.nodeStorage.WaitDurable()
+}
+
+func (t *TPagedBTree) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	return t.ScanContext(context.Background(), start, end, fn)
+}
+
+// fn must not call the tree, as it is locked for the whole scan
+func (t *TPagedBTree) ScanContext(ctx context.Context, start, end []byte, fn func(key, value []byte) bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, err := t.scan(ctx, t.nodeStorage.RootNode(), start, end, fn)
+	return err
+}
+
+/*
+With maxKeysCount == 0 nodes are split only when the next tuple would not fit into a page
+and the split point balances bytes between the halves, otherwise maxKeysCount must be odd.
+*/
+func MakePagedBTree(nodeStorage storage.INodeStorage, maxKeysCount uint32) *TPagedBTree {
+	return MakePagedBTreeWithConfig(nodeStorage, TConfig{MaxKeysCount: maxKeysCount})
+}
+
+/*
+Returns nil for a storage with buffered messages or keys ordered by an unsupported comparator.
+The append fast path is not supported with copy-on-write, which moves the leaf it holds between puts.
+*/
+func MakePagedBTreeWithConfig(nodeStorage storage.INodeStorage, config TConfig) *TPagedBTree {
+	if config.MaxKeysCount != 0 && config.MaxKeysCount%2 != 1 {
+		return nil
+	}
+	if config.SplitRatio < 0 || config.SplitRatio >= 1 || config.AppendSplitRatio < 0 || config.AppendSplitRatio >= 1 {
+		return nil
+	}
+	storageConfig := nodeStorage.Config()
+	if storageConfig.ComparatorId != storage.ComparatorBytewise || storageConfig.Features&storage.FeatureMessages != 0 {
+		return nil
+	}
+	if config.AppendFastPath && storageConfig.CopyOnWrite {
+		return nil
+	}
+	return &TPagedBTree{nodeStorage: nodeStorage, maxKeysCount: int(config.MaxKeysCount), config: config, mutex: &sync.Mutex{}}
+}
+
+/******************* PRIVATE *******************/
+func (t *TPagedBTree) putAtomically(ctx context.Context, key, value []byte) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	if err := checkTupleSize(t.nodeStorage.Config(), key, value); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err := t.nodeStorage.Begin(); err != nil {
+		return err
+	}
+	if err := t.put(ctx, key, value); err != nil {
+		t.rightmostLeaf = nil
+		return rollback(t.nodeStorage, err)
+	}
+	if err := t.nodeStorage.Commit(); err != nil {
+		t.rightmostLeaf = nil
+		return rollback(t.nodeStorage, err)
+	}
+	return nil
+}
+
+func (t *TPagedBTree) put(ctx context.Context, key, value []byte) error {
+	if done, err := t.appendToRightmostLeaf(key, value); err != nil || done {
+		return err
+	}
+	t.rightmostLeaf = nil
 	root := t.nodeStorage.RootNode()
-	if root.KeyCount() == t.maxKeysCount {
+	if t.isFull(root, key, value) {
+		ratio, err := t.splitRatio(root, key, true)
+		if err != nil {
+			return err
+		}
 		newRoot, err := t.nodeStorage.AllocateRootNode()
 		if err != nil {
 			return err
 		}
-		if _, err := t.splitChild(newRoot, root); err != nil {
+		if _, _, err := t.splitChild(newRoot, root, ratio); err != nil {
 			return err
 		}
 		root = newRoot
 	}
-	return t.insertNonFull(root, key, value)
+	return t.insertNonFull(ctx, root, key, value, true)
 }
 
-func MakePagedBTree(nodeStorage storage.INodeStorage, maxKeysCount uint32) *TPagedBTree {
-	if maxKeysCount%2 != 1 {
-		return nil
+// keeps the original error, a failure to roll back is appended to it
+func rollback(nodeStorage storage.INodeStorage, err error) error {
+	if rollbackErr := nodeStorage.Rollback(); rollbackErr != nil {
+		return fmt.Errorf("%w, rollback failed with error [%v]", err, rollbackErr)
 	}
-	return &TPagedBTree{nodeStorage: nodeStorage, maxKeysCount: int(maxKeysCount), mutex: &sync.Mutex{}}
+	return err
+}
+
+// converts a result of Get into a result of Has
+func found(err error) (bool, error) {
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-/******************* PRIVATE *******************/
 /*
 Compares two byte arrays, returns integer:
 if lhs < rhs:	-1
@@ -111,85 +205,239 @@ func compare(lhs []byte, rhs io.Reader, chunkSize int) (int8, error) {
 	}
 }
 
-func (t *TPagedBTree) splitChild(parent, child storage.INode) (storage.INode, error) {
+/*
+A leaf is full when the tuple being inserted does not fit into it, an internal node is full
+when a separator of the max size does not fit into it, since any key of a child may be promoted.
+*/
+func (t *TPagedBTree) isFull(node storage.INode, key, value []byte) bool {
+	if t.maxKeysCount != 0 && node.KeyCount() >= t.maxKeysCount {
+		return true
+	}
+	if node.IsLeaf() {
+		return !node.Fits(len(key), len(value))
+	}
+	return !node.Fits(int(t.nodeStorage.Config().MaxTupleSize(false))-4, 0)
+}
+
+// counts keys or, when splitting by bytes, sums sizes of tuples in [start, end)
+func (t *TPagedBTree) weight(node storage.INode, start, end int) uint32 {
+	if t.maxKeysCount != 0 {
+		return uint32(end - start)
+	}
+	total := uint32(0)
+	for i := start; i < end; i++ {
+		total += node.TupleSize(i)
+	}
+	return total
+}
+
+// returns an index of the first key which is moved to the right node, the left one keeps ratio of the weight
+func (t *TPagedBTree) splitIdx(node storage.INode, ratio float64) int {
+	if t.maxKeysCount == 0 {
+		return byteSplitIdx(node, ratio)
+	}
+	return clampSplitIdx(node, int(float64(node.KeyCount())*ratio))
+}
+
+// same as splitIdx, but ratio is always applied to sizes of tuples
+func byteSplitIdx(node storage.INode, ratio float64) int {
+	total := uint32(0)
+	for i := 0; i < node.KeyCount(); i++ {
+		total += node.TupleSize(i)
+	}
+	target := float64(total) * ratio
+	left := uint32(0)
+	idx := 0
+	for ; idx < node.KeyCount(); idx++ {
+		size := node.TupleSize(idx)
+		if float64(left)+float64(size)/2 > target {
+			break
+		}
+		left += size
+	}
+	return clampSplitIdx(node, idx)
+}
+
+// both halves must be non-empty
+func clampSplitIdx(node storage.INode, idx int) int {
+	count := node.KeyCount()
+	if idx < 1 {
+		idx = 1
+	}
+	if idx > count-1 {
+		idx = count - 1
+	}
+	return idx
+}
+
+/*
+Sequential inserts always go past the end of the rightmost node, splitting it in halves
+would leave every left node half empty, so such nodes are split with AppendSplitRatio.
+*/
+func (t *TPagedBTree) splitRatio(node storage.INode, key []byte, rightmost bool) (float64, error) {
+	ratio := t.config.SplitRatio
+	if ratio == 0 {
+		ratio = 0.5
+	}
+	if !rightmost || t.config.AppendSplitRatio == 0 || node.KeyCount() == 0 {
+		return ratio, nil
+	}
+	rel, err := compare(key, node.Key(node.KeyCount()-1), chunkSize)
+	if err != nil {
+		return 0, err
+	}
+	if rel == 1 {
+		ratio = t.config.AppendSplitRatio
+	}
+	return ratio, nil
+}
+
+/*
+The rightmost leaf holds all keys greater than the last separator on the rightmost path,
+so a key greater than its max key may be appended to it directly, while it has room.
+*/
+func (t *TPagedBTree) appendToRightmostLeaf(key, value []byte) (bool, error) {
+	if t.rightmostLeaf != nil && t.rightmostGeneration != t.nodeStorage.Generation() {
+		t.rightmostLeaf = nil
+	}
+	leaf := t.rightmostLeaf
+	if !t.config.AppendFastPath || leaf == nil || leaf.KeyCount() == 0 || t.isFull(leaf, key, value) {
+		return false, nil
+	}
+	rel, err := compare(key, leaf.Key(leaf.KeyCount()-1), chunkSize)
+	if err != nil || rel != 1 {
+		return false, err
+	}
+	leaf.InsertKeyValue(key, value, leaf.KeyCount())
+	if err := leaf.Save(); err != nil {
+		t.rightmostLeaf = nil
+		return true, err
+	}
+	return true, nil
+}
+
+func (t *TPagedBTree) saveLeaf(leaf storage.INode, rightmost bool) error {
+	if err := leaf.Save(); err != nil {
+		return err
+	}
+	if rightmost && t.config.AppendFastPath {
+		t.rightmostLeaf = leaf
+		t.rightmostGeneration = t.nodeStorage.Generation()
+	}
+	return nil
+}
+
+func (t *TPagedBTree) splitChild(parent, child storage.INode, ratio float64) (storage.INode, []byte, error) {
 	lhs := child
-	pivotKeyIdx := lhs.KeyCount() / 2
+	pivotKeyIdx := t.splitIdx(lhs, ratio)
 	pivotKey, err := lhs.KeyFull(pivotKeyIdx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	i := parent.KeyCount() - 1
-	for {
-		if i < 0 {
-			break
-		}
-		rel, err := compare(pivotKey, parent.Key(i), chunkSize)
-		if err != nil {
-			return nil, err
-		}
-		if rel > -1 {
-			break
-		}
-		i -= 1
+	i, found := parent.Search(pivotKey)
+	if found {
+		i += 1
 	}
-	i += 1
 	rhs, err := lhs.SplitAt(pivotKeyIdx)
-	parent.InsertKey(pivotKey, i)
-	parent.InsertChild(rhs.Id(), i+1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	parent.InsertKey(pivotKey, i)
+	parent.InsertChild(rhs.Id(), i+1)
 	if err := parent.Save(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := lhs.Save(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := rhs.Save(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return rhs, nil
+	return rhs, pivotKey, nil
 }
 
-func (t *TPagedBTree) insertNonFull(node storage.INode, key, value []byte) error {
-	i := node.KeyCount() - 1
-	lastCompare := int8(1)
-	for ; i >= 0; i-- {
-		var err error
-		lastCompare, err = compare(key, node.Key(i), chunkSize)
-		if err != nil {
-			return err
-		}
-		if lastCompare != -1 {
-			break
-		}
-	}
-	if node.IsLeaf() && lastCompare == 0 {
+// rightmost is set when the node is the last one on its level
+func (t *TPagedBTree) insertNonFull(ctx context.Context, node storage.INode, key, value []byte, rightmost bool) error {
+	i, found := node.Search(key)
+	if node.IsLeaf() && found {
 		node.UpdateValue(i, value)
-		return node.Save()
+		return t.saveLeaf(node, rightmost)
+	}
+	if found {
+		i += 1
 	}
-	i += 1
 	if node.IsLeaf() {
 		node.InsertKeyValue(key, value, i)
-		return node.Save()
+		return t.saveLeaf(node, rightmost)
 	}
-	child, err := t.nodeStorage.LoadNode(node.Child(i))
+	child, err := t.nodeStorage.LoadNodeContext(ctx, node.Child(i))
 	if err != nil {
 		return err
 	}
-	if child.KeyCount() == t.maxKeysCount {
-		pivotKey := child.Key(child.KeyCount() / 2)
-		newChild, err := t.splitChild(node, child)
+	childRightmost := rightmost && i == node.KeyCount()
+	if t.isFull(child, key, value) {
+		if t.config.Redistribute && child.IsLeaf() {
+			done, err := t.redistribute(ctx, node, i, child, key, value)
+			if err != nil {
+				return err
+			}
+			if done {
+				return t.insertNonFull(ctx, node, key, value, rightmost)
+			}
+		}
+		ratio, err := t.splitRatio(child, key, childRightmost)
 		if err != nil {
 			return err
 		}
-		rel, err := compare(key, pivotKey, chunkSize)
+		newChild, pivotKey, err := t.splitChild(node, child, ratio)
 		if err != nil {
 			return err
 		}
-		if rel != -1 {
+		if bytes.Compare(key, pivotKey) != -1 {
 			child = newChild
+		} else {
+			childRightmost = false
+		}
+	}
+	return t.insertNonFull(ctx, child, key, value, childRightmost)
+}
+
+// visits keys from [start, end) in order, nil bounds are open, returns false when fn stopped the scan
+func (t *TPagedBTree) scan(ctx context.Context, node storage.INode, start, end []byte, fn func(key, value []byte) bool) (bool, error) {
+	for i := 0; i < node.KeyCount() || (!node.IsLeaf() && i == node.KeyCount()); i++ {
+		var key []byte
+		if i < node.KeyCount() {
+			var err error
+			if key, err = node.KeyFull(i); err != nil {
+				return false, err
+			}
+		}
+		if node.IsLeaf() {
+			if start != nil && bytes.Compare(key, start) == -1 {
+				continue
+			}
+			if end != nil && bytes.Compare(key, end) != -1 {
+				return false, nil
+			}
+			if !fn(key, node.Value(i)) {
+				return false, nil
+			}
+			continue
+		}
+		// child i holds keys less than key i
+		if node.Child(i) == storage.InvalidNodeId || (key != nil && start != nil && bytes.Compare(key, start) != 1) {
+			continue
+		}
+		child, err := t.nodeStorage.LoadNodeContext(ctx, node.Child(i))
+		if err != nil {
+			return false, err
+		}
+		if proceed, err := t.scan(ctx, child, start, end, fn); err != nil || !proceed {
+			return false, err
+		}
+		if key != nil && end != nil && bytes.Compare(key, end) != -1 {
+			return false, nil
 		}
 	}
-	return t.insertNonFull(child, key, value)
+	return true, nil
 }
@@ -1,7 +1,11 @@
 package btree_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -56,13 +60,17 @@ var values20 = [][]byte{
 }
 
 func putAndGet(t *testing.T, keys, values [][]byte, maxKeysCount uint32) {
+	putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount})
+}
+
+func putAndGetWithConfig(t *testing.T, keys, values [][]byte, treeConfig btree.TConfig) int {
 	filePath := "./" + util.TimeBasedFileName()
 	defer os.Remove(filePath)
-	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: maxKeysCount}
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: treeConfig.MaxKeysCount}
 	strg, err := storage.MakeNodeStorage(config)
 	require.Empty(t, err)
 	defer strg.Close()
-	btree := btree.MakePagedBTree(strg, maxKeysCount)
+	btree := btree.MakePagedBTreeWithConfig(strg, treeConfig)
 	require.NotEmpty(t, btree)
 	util.PrintStats(strg)
 	for i, key := range keys {
@@ -77,6 +85,7 @@ func putAndGet(t *testing.T, keys, values [][]byte, maxKeysCount uint32) {
 		require.Equal(t, values[i], val)
 	}
 	util.PrintStats(strg)
+	return countNodes(t, strg)
 }
 
 func TestInsertOrdered(t *testing.T) {
@@ -181,3 +190,349 @@ func TestUpdateValues(t *testing.T) {
 		require.Equal(t, values[i], val)
 	}
 }
+
+func TestInsertByteBudget(t *testing.T) {
+	putAndGet(t, keys20, values20, 0)
+}
+
+func TestInsertByteBudgetVariableSizes(t *testing.T) {
+	keys := make([][]byte, 500)
+	values := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i))
+		values[i] = bytes.Repeat([]byte{byte('a' + i%26)}, (i*37)%200)
+	}
+	util.ShuffleSliceBytes(keys)
+	for i, key := range keys {
+		values[i] = bytes.Repeat(key[len(key)-1:], len(values[i]))
+	}
+	putAndGet(t, keys, values, 0)
+}
+
+func countNodes(t *testing.T, strg storage.INodeStorage) int {
+	count := 0
+	queue := []storage.INode{strg.RootNode()}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		count++
+		if node.IsLeaf() {
+			continue
+		}
+		for i := 0; i <= node.KeyCount(); i++ {
+			if node.Child(i) == storage.InvalidNodeId {
+				continue
+			}
+			child, err := strg.LoadNode(node.Child(i))
+			require.Empty(t, err)
+			queue = append(queue, child)
+		}
+	}
+	return count
+}
+
+func TestByteBudgetFitsMoreSmallTuples(t *testing.T) {
+	countPages := func(maxKeysCount uint32) int {
+		filePath := "./" + util.TimeBasedFileName()
+		defer os.Remove(filePath)
+		config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: maxKeysCount}
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		defer strg.Close()
+		tree := btree.MakePagedBTree(strg, maxKeysCount)
+		require.NotEmpty(t, tree)
+		for i := 0; i < 300; i++ {
+			require.Empty(t, tree.Put([]byte(fmt.Sprintf("%04d", i)), []byte("v")))
+		}
+		return countNodes(t, strg)
+	}
+	require.Less(t, countPages(0), countPages(11))
+}
+
+func TestPutTooLarge(t *testing.T) {
+	for _, maxKeysCount := range []uint32{0, 5} {
+		filePath := "./" + util.TimeBasedFileName()
+		config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: maxKeysCount}
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		tree := btree.MakePagedBTree(strg, maxKeysCount)
+		require.NotEmpty(t, tree)
+		require.ErrorIs(t, tree.Put(bytes.Repeat([]byte("k"), 1024), []byte("v")), btree.ErrKeyTooLarge)
+		require.ErrorIs(t, tree.Put([]byte("k"), bytes.Repeat([]byte("v"), 1024)), btree.ErrValueTooLarge)
+		require.Empty(t, tree.Put([]byte("k"), []byte("v")))
+		val, err := tree.Get([]byte("k"))
+		require.Empty(t, err)
+		require.Equal(t, []byte("v"), val)
+		require.Empty(t, strg.Close())
+		os.Remove(filePath)
+	}
+}
+
+func manyKeys(count int) ([][]byte, [][]byte) {
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i))
+		values[i] = []byte(fmt.Sprintf("value%d", i))
+	}
+	return keys, values
+}
+
+func TestRedistribute(t *testing.T) {
+	for _, maxKeysCount := range []uint32{0, 5} {
+		keys, values := manyKeys(600)
+		plain := putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount})
+		redistributed := putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount, Redistribute: true})
+		require.Less(t, redistributed, plain)
+
+		util.ReverseSliceBytes(keys)
+		util.ReverseSliceBytes(values)
+		putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount, Redistribute: true})
+
+		util.ShuffleSliceBytes(keys)
+		for i, key := range keys {
+			values[i] = append([]byte("value-of-"), key...)
+		}
+		putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount, Redistribute: true})
+	}
+}
+
+func TestAppendSplitRatio(t *testing.T) {
+	for _, maxKeysCount := range []uint32{0, 5} {
+		keys, values := manyKeys(600)
+		plain := putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount})
+		appended := putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount, AppendSplitRatio: 0.9})
+		require.Less(t, appended*3, plain*2)
+
+		util.ShuffleSliceBytes(keys)
+		for i, key := range keys {
+			values[i] = append([]byte("value-of-"), key...)
+		}
+		putAndGetWithConfig(t, keys, values, btree.TConfig{MaxKeysCount: maxKeysCount, AppendSplitRatio: 0.9, SplitRatio: 0.7})
+	}
+	require.Empty(t, btree.MakePagedBTreeWithConfig(nil, btree.TConfig{SplitRatio: 1}))
+	require.Empty(t, btree.MakePagedBTreeWithConfig(nil, btree.TConfig{AppendSplitRatio: -0.5}))
+}
+
+func TestAppendFastPath(t *testing.T) {
+	readCalls := func(treeConfig btree.TConfig) uint64 {
+		filePath := "./" + util.TimeBasedFileName()
+		defer os.Remove(filePath)
+		config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: treeConfig.MaxKeysCount}
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		defer strg.Close()
+		tree := btree.MakePagedBTreeWithConfig(strg, treeConfig)
+		require.NotEmpty(t, tree)
+		keys, values := manyKeys(600)
+		// appends interleaved with updates and inserts in the middle
+		for i, key := range keys {
+			require.Empty(t, tree.Put(key, values[i]))
+			if i%50 == 49 {
+				require.Empty(t, tree.Put(keys[i/2], []byte("updated")))
+				values[i/2] = []byte("updated")
+				require.Empty(t, tree.Put(append(keys[i/3], '!'), []byte("inserted")))
+			}
+		}
+		reads := strg.Statistics().ReadCalls
+		for i, key := range keys {
+			val, err := tree.Get(key)
+			require.Empty(t, err)
+			require.Equal(t, values[i], val)
+		}
+		for i := 49; i < len(keys); i += 50 {
+			val, err := tree.Get(append(keys[i/3], '!'))
+			require.Empty(t, err)
+			require.Equal(t, []byte("inserted"), val)
+		}
+		return reads
+	}
+	for _, maxKeysCount := range []uint32{0, 5} {
+		plain := readCalls(btree.TConfig{MaxKeysCount: maxKeysCount})
+		fast := readCalls(btree.TConfig{MaxKeysCount: maxKeysCount, AppendFastPath: true, AppendSplitRatio: 0.9})
+		require.Less(t, fast*2, plain)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 3}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTree(strg, 3)
+	for i, key := range keys20 {
+		require.Empty(t, tree.Put(key, values20[i]))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tree.GetContext(ctx, keys20[0])
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, tree.PutContext(ctx, []byte("new"), []byte("value")), context.Canceled)
+	require.ErrorIs(t, tree.ScanContext(ctx, nil, nil, func(key, value []byte) bool { return true }), context.Canceled)
+	for i, key := range keys20 {
+		val, err := tree.Get(key)
+		require.Empty(t, err)
+		require.Equal(t, values20[i], val)
+	}
+}
+
+func checkScan(t *testing.T, tree btree.IBTree) {
+	keys, values := manyKeys(300)
+	util.ShuffleSliceBytes(keys)
+	for i, key := range keys {
+		values[i] = append([]byte("value-of-"), key...)
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	scanner, ok := tree.(btree.IScanner)
+	require.True(t, ok)
+	scan := func(start, end []byte, limit int) []string {
+		result := []string{}
+		require.Empty(t, scanner.Scan(start, end, func(key, value []byte) bool {
+			require.Equal(t, append([]byte("value-of-"), key...), value)
+			result = append(result, string(key))
+			return len(result) < limit
+		}))
+		return result
+	}
+	all := scan(nil, nil, 1000)
+	require.Len(t, all, 300)
+	require.True(t, sort.StringsAreSorted(all))
+	require.Equal(t, all[100:200], scan([]byte("key0100"), []byte("key0200"), 1000))
+	require.Equal(t, all[100:201], scan([]byte("key0099!"), []byte("key0200!"), 1000))
+	require.Equal(t, all[250:260], scan([]byte("key0250"), nil, 10))
+	require.Equal(t, all[:7], scan(nil, []byte("key0007"), 1000))
+	require.Empty(t, scan([]byte("key0200"), []byte("key0100"), 1000))
+}
+
+func TestScan(t *testing.T) {
+	checkScan(t, btree.MakeDummyBTree())
+	for _, maxKeysCount := range []uint32{0, 5} {
+		filePath := "./" + util.TimeBasedFileName()
+		defer os.Remove(filePath)
+		strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: maxKeysCount})
+		require.Empty(t, err)
+		defer strg.Close()
+		checkScan(t, btree.MakePagedBTree(strg, maxKeysCount))
+	}
+}
+
+func checkMissingAndEmpty(t *testing.T, tree btree.IBTree) {
+	_, err := tree.Get([]byte("missing"))
+	require.ErrorIs(t, err, btree.ErrNotFound)
+	has, err := tree.Has([]byte("missing"))
+	require.Empty(t, err)
+	require.False(t, has)
+	for _, value := range [][]byte{nil, {}} {
+		require.Empty(t, tree.Put([]byte("empty"), value))
+		val, err := tree.Get([]byte("empty"))
+		require.Empty(t, err)
+		require.NotNil(t, val)
+		require.Empty(t, val)
+		has, err = tree.Has([]byte("empty"))
+		require.Empty(t, err)
+		require.True(t, has)
+	}
+}
+
+func TestMissingAndEmpty(t *testing.T) {
+	checkMissingAndEmpty(t, btree.MakeDummyBTree())
+	for _, maxKeysCount := range []uint32{0, 5} {
+		filePath := "./" + util.TimeBasedFileName()
+		defer os.Remove(filePath)
+		strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: maxKeysCount})
+		require.Empty(t, err)
+		defer strg.Close()
+		tree := btree.MakePagedBTree(strg, maxKeysCount)
+		for i, key := range keys20 {
+			require.Empty(t, tree.Put(key, values20[i]))
+		}
+		checkMissingAndEmpty(t, tree)
+	}
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	tree, strg := makeBufferedTree(t, filePath)
+	checkMissingAndEmpty(t, tree)
+	require.Empty(t, tree.Delete([]byte("empty")))
+	_, err := tree.Get([]byte("empty"))
+	require.ErrorIs(t, err, btree.ErrNotFound)
+	require.Empty(t, strg.Close())
+
+	// empty values survive reopening
+	tree, strg = makeBufferedTree(t, filePath)
+	defer strg.Close()
+	for i := 0; i < 300; i++ {
+		require.Empty(t, tree.Put([]byte(fmt.Sprintf("key%04d", i)), nil))
+	}
+	require.Empty(t, strg.Close())
+	tree, strg = makeBufferedTree(t, filePath)
+	defer strg.Close()
+	val, err := tree.Get([]byte("key0123"))
+	require.Empty(t, err)
+	require.Equal(t, []byte{}, val)
+}
+
+func TestClosed(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 3})
+	require.Empty(t, err)
+	tree := btree.MakePagedBTree(strg, 3)
+	for i, key := range keys20 {
+		require.Empty(t, tree.Put(key, values20[i]))
+	}
+	require.Empty(t, strg.Close())
+	_, err = tree.Get(keys20[0])
+	require.ErrorIs(t, err, btree.ErrClosed)
+	require.ErrorIs(t, tree.Put(keys20[0], values20[0]), btree.ErrClosed)
+}
+
+// average share of MaxKeysCount used by leaves of the tree
+func leafOccupancy(t *testing.T, keys, values [][]byte, treeConfig btree.TConfig) float64 {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: treeConfig.MaxKeysCount})
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, treeConfig)
+	require.NotEmpty(t, tree)
+	for i, key := range keys {
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	leaves, tuples := 0, 0
+	queue := []storage.INode{strg.RootNode()}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node.IsLeaf() {
+			leaves++
+			tuples += node.KeyCount()
+			continue
+		}
+		for i := 0; i <= node.KeyCount(); i++ {
+			if node.Child(i) == storage.InvalidNodeId {
+				continue
+			}
+			child, err := strg.LoadNode(node.Child(i))
+			require.Empty(t, err)
+			queue = append(queue, child)
+		}
+	}
+	return float64(tuples) / float64(leaves*int(treeConfig.MaxKeysCount))
+}
+
+// leaves split two into three stay about 2/3 full, against about 1/2 with plain splits of sequential keys
+func TestRedistributeOccupancy(t *testing.T) {
+	keys, values := manyKeys(2000)
+	plain := leafOccupancy(t, keys, values, btree.TConfig{MaxKeysCount: 11})
+	sequential := leafOccupancy(t, keys, values, btree.TConfig{MaxKeysCount: 11, Redistribute: true})
+	require.InDelta(t, 2.0/3, sequential, 0.05)
+	require.Greater(t, sequential, plain)
+
+	util.ShuffleSliceBytes(keys)
+	plain = leafOccupancy(t, keys, values, btree.TConfig{MaxKeysCount: 11})
+	random := leafOccupancy(t, keys, values, btree.TConfig{MaxKeysCount: 11, Redistribute: true})
+	require.GreaterOrEqual(t, random, 2.0/3)
+	require.Greater(t, random, plain)
+}
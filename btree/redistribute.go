@@ -0,0 +1,158 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/vladem/btree/storage"
+)
+
+/*
+B*-tree style handling of a full leaf: before splitting, tuples of the leaf are shifted into
+an adjacent sibling which has room, and the separator in the parent is updated. When that is not
+possible, the leaf and its sibling are split into three nodes, so leaves stay at least ~2/3 full.
+Returns false when the child has no siblings and has to be split in a regular way.
+Only leaves are redistributed, full internal nodes are still split 1:2 by splitChild, as they hold
+a small share of the tuples and their separators would have to be rotated through the parent.
+Requires the parent to be non-full, as it may receive one more separator.
+*/
+func (t *TPagedBTree) redistribute(ctx context.Context, parent storage.INode, childIdx int, child storage.INode, key, value []byte) (bool, error) {
+	var left, right storage.INode
+	if childIdx < parent.KeyCount() && parent.Child(childIdx+1) != storage.InvalidNodeId {
+		var err error
+		if right, err = t.nodeStorage.LoadNodeContext(ctx, parent.Child(childIdx+1)); err != nil {
+			return false, err
+		}
+		if done, err := t.shift(parent, childIdx, child, right, true, key, value); err != nil || done {
+			return done, err
+		}
+	}
+	if childIdx > 0 && parent.Child(childIdx-1) != storage.InvalidNodeId {
+		var err error
+		if left, err = t.nodeStorage.LoadNodeContext(ctx, parent.Child(childIdx-1)); err != nil {
+			return false, err
+		}
+		if done, err := t.shift(parent, childIdx-1, left, child, false, key, value); err != nil || done {
+			return done, err
+		}
+	}
+	if right != nil {
+		return true, t.splitTwoToThree(parent, childIdx, child, right)
+	}
+	if left != nil {
+		return true, t.splitTwoToThree(parent, childIdx-1, left, child)
+	}
+	return false, nil
+}
+
+/*
+Moves tuples from one of two adjacent leaves to the other one, until their weights are balanced.
+Separator between the leaves is the key parent.Key(sepIdx). Nothing is changed if afterwards
+the leaf receiving the key would still be full.
+*/
+func (t *TPagedBTree) shift(parent storage.INode, sepIdx int, lhs, rhs storage.INode, toRight bool, key, value []byte) (bool, error) {
+	src, dst := lhs, rhs
+	if !toRight {
+		src, dst = rhs, lhs
+	}
+	moved := 0
+	for src.KeyCount() > 1 {
+		srcIdx, dstIdx := 0, dst.KeyCount()
+		if toRight {
+			srcIdx, dstIdx = src.KeyCount()-1, 0
+		}
+		size := t.weight(src, srcIdx, srcIdx+1)
+		if moved > 0 && t.weight(src, 0, src.KeyCount())-size < t.weight(dst, 0, dst.KeyCount())+size {
+			break
+		}
+		movedKey, err := src.KeyFull(srcIdx)
+		if err != nil {
+			return false, err
+		}
+		if t.isFull(dst, movedKey, src.Value(srcIdx)) {
+			break
+		}
+		dst.InsertKeyValue(movedKey, src.Value(srcIdx), dstIdx)
+		src.RemoveKeyValue(srcIdx)
+		moved++
+	}
+	separator, err := rhs.KeyFull(0)
+	if err != nil {
+		return false, err
+	}
+	target := rhs
+	if bytes.Compare(key, separator) == -1 {
+		target = lhs
+	}
+	if moved == 0 || t.isFull(target, key, value) {
+		for ; moved > 0; moved-- {
+			srcIdx, dstIdx := dst.KeyCount()-1, 0
+			if toRight {
+				srcIdx, dstIdx = 0, src.KeyCount()
+			}
+			if err := moveTuple(dst, srcIdx, src, dstIdx); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	parent.UpdateKey(sepIdx, separator)
+	return true, saveAll(parent, lhs, rhs)
+}
+
+/*
+Splits two adjacent full leaves into three, the new one is inserted right after rhs.
+Separator between the leaves is the key parent.Key(sepIdx).
+*/
+func (t *TPagedBTree) splitTwoToThree(parent storage.INode, sepIdx int, lhs, rhs storage.INode) error {
+	for rhs.KeyCount() > 0 {
+		if err := moveTuple(rhs, 0, lhs, lhs.KeyCount()); err != nil {
+			return err
+		}
+	}
+	firstIdx := t.splitIdx(lhs, 1.0/3)
+	secondIdx := t.splitIdx(lhs, 2.0/3)
+	if secondIdx <= firstIdx {
+		secondIdx = firstIdx + 1
+	}
+	third, err := lhs.SplitAt(secondIdx)
+	if err != nil {
+		return err
+	}
+	for lhs.KeyCount() > firstIdx {
+		if err := moveTuple(lhs, firstIdx, rhs, rhs.KeyCount()); err != nil {
+			return err
+		}
+	}
+	firstSeparator, err := rhs.KeyFull(0)
+	if err != nil {
+		return err
+	}
+	secondSeparator, err := third.KeyFull(0)
+	if err != nil {
+		return err
+	}
+	parent.UpdateKey(sepIdx, firstSeparator)
+	parent.InsertKey(secondSeparator, sepIdx+1)
+	parent.InsertChild(third.Id(), sepIdx+2)
+	return saveAll(parent, lhs, rhs, third)
+}
+
+func moveTuple(src storage.INode, srcIdx int, dst storage.INode, dstIdx int) error {
+	key, err := src.KeyFull(srcIdx)
+	if err != nil {
+		return err
+	}
+	dst.InsertKeyValue(key, src.Value(srcIdx), dstIdx)
+	src.RemoveKeyValue(srcIdx)
+	return nil
+}
+
+func saveAll(nodes ...storage.INode) error {
+	for _, node := range nodes {
+		if err := node.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
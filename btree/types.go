@@ -1,13 +1,36 @@
 package btree
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/vladem/btree/storage"
 )
 
+var (
+	ErrNotFound = errors.New("key not found")
+	// errors of the node storage, exposed so that callers may only depend on this package
+	ErrKeyTooLarge   = storage.ErrKeyTooLarge
+	ErrValueTooLarge = storage.ErrValueTooLarge
+	ErrClosed        = storage.ErrClosed
+	ErrCorrupted     = storage.ErrCorrupted
+)
+
+type TConfig struct {
+	MaxKeysCount     uint32  // must be odd, 0 means that nodes are split only when the next tuple does not fit into a page
+	Redistribute     bool    // a full leaf shifts tuples to an adjacent sibling, two full leaves are split into three, internal nodes are excluded and split in two
+	SplitRatio       float64 // share of keys (or bytes) kept by the left node on split, 0 means 0.5
+	AppendSplitRatio float64 // used instead of SplitRatio when a key is appended past the end of the rightmost node, 0 disables
+	AppendFastPath   bool    // keys greater than the max key are put to the rightmost leaf without a descent from the root
+}
+
 type TPagedBTree struct {
 	nodeStorage  storage.INodeStorage
 	maxKeysCount int
+	config       TConfig
 	mutex        *sync.Mutex
+	// last modified rightmost leaf, only set with AppendFastPath
+	rightmostLeaf storage.INode
+	// generation of the storage the leaf was loaded at, a compaction makes the leaf stale
+	rightmostGeneration uint64
 }
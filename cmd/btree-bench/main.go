@@ -0,0 +1,292 @@
+/*
+btree-bench runs YCSB-style workloads against an embedded tree or a running server and reports
+latency percentiles, throughput and, for embedded trees, storage I/O per operation.
+
+	go run ./cmd/btree-bench -workload read-heavy -distribution zipfian -records 10000 -operations 100000
+	go run ./cmd/btree-bench -target server -addr localhost:8080 -clients 2 -workload update-heavy
+
+A run loads -records records first, then performs -operations operations split between -clients clients.
+Each client of a server target holds a connection, so there should be no more clients than server workers.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+type tBenchConfig struct {
+	workload     tWorkload
+	distribution string
+	records      int64
+	operations   int64
+	clients      int
+	valueSize    int
+	scanLength   int
+	zipfExponent float64
+	seed         int64
+}
+
+type tClient struct {
+	session   ISession
+	rng       *rand.Rand
+	chooser   IKeyChooser
+	latencies *tLatencies
+}
+
+func main() {
+	targetKind := flag.String("target", "embedded", "'embedded' to open a tree in process or 'server' to connect to a running one")
+	addr := flag.String("addr", "localhost:8080", "address of the server target")
+	path := flag.String("path", "./bench.db", "file of the embedded target, must not exist")
+	keepDb := flag.Bool("keep", false, "keep the file of the embedded target after the run")
+	pageSize := flag.Uint("page-size", 1024, "page size of the embedded target")
+	maxKeys := flag.Uint("max-keys", 0, "max keys in a node (odd), 0 to split nodes by page bytes")
+	poolBytes := flag.Uint("pool-bytes", 0, "budget of the page buffer pool of the embedded target, 0 disables it")
+	wal := flag.Bool("wal", false, "log operations of the embedded target to a write-ahead log")
+	mmap := flag.Bool("mmap", false, "decode nodes of the embedded target from a memory mapping of its file")
+	compress := flag.Bool("compress", false, "compress pages of the embedded target with flate, takes pages of 8KB or more")
+	durabilityName := flag.String("durability", "none", "when puts of the embedded target are synced, 'none', 'sync', 'timer' or 'group' (requires -pool-bytes and -wal)")
+	mode := flag.String("mode", "paged", "tree implementation of the embedded target, 'paged' or 'buffered'")
+	redistribute := flag.Bool("redistribute", false, "shift keys to siblings before splitting leaves")
+	workloadName := flag.String("workload", "read-heavy", "'read-heavy', 'update-heavy', 'scan-heavy' or 'insert-only'")
+	distribution := flag.String("distribution", "uniform", "key distribution, 'uniform', 'zipfian' or 'sequential'")
+	records := flag.Int64("records", 10000, "records loaded before the run")
+	operations := flag.Int64("operations", 100000, "operations performed during the run")
+	clients := flag.Int("clients", 1, "concurrent clients")
+	valueSize := flag.Int("value-size", 100, "size of values in bytes")
+	scanLength := flag.Int("scan-length", 100, "max keys visited by a scan, the length is uniform in [1, scan-length]")
+	zipfExponent := flag.Float64("zipf-exponent", 1.1, "exponent of the zipfian distribution, greater than 1")
+	seed := flag.Int64("seed", 1, "seed of random choices")
+	flag.Parse()
+
+	workload, ok := workloads[*workloadName]
+	if !ok {
+		log.Fatalf("unknown workload [%v]\n", *workloadName)
+	}
+	if *records < 1 || *operations < 1 || *clients < 1 || *scanLength < 1 || *valueSize < 0 {
+		log.Fatalf("records, operations, clients and scan length must be positive\n")
+	}
+	config := tBenchConfig{
+		workload:     workload,
+		distribution: *distribution,
+		records:      *records,
+		operations:   *operations,
+		clients:      *clients,
+		valueSize:    *valueSize,
+		scanLength:   *scanLength,
+		zipfExponent: *zipfExponent,
+		seed:         *seed,
+	}
+	var (
+		target ITarget
+		err    error
+	)
+	switch *targetKind {
+	case "embedded":
+		durability, parseErr := storage.ParseDurability(*durabilityName)
+		if parseErr != nil {
+			log.Fatalf("failed to parse durability with error [%v]\n", parseErr)
+		}
+		storageConfig := storage.TConfig{
+			PageSizeBytes:   uint32(*pageSize),
+			FilePath:        *path,
+			MaxCellsCount:   uint32(*maxKeys),
+			BufferPoolBytes: uint32(*poolBytes),
+			WriteAheadLog:   *wal,
+			MemoryMapped:    *mmap,
+			Durability:      durability,
+		}
+		if *compress {
+			storageConfig.PageCodec = storage.CodecFlate
+		}
+		target, err = makeEmbeddedTarget(storageConfig, *mode, *redistribute, *keepDb)
+	case "server":
+		target = &tServerTarget{addr: *addr}
+	default:
+		err = fmt.Errorf("unknown target [%v]", *targetKind)
+	}
+	if err != nil {
+		log.Fatalf("failed to create target with error [%v]\n", err)
+	}
+	defer target.Close()
+	fmt.Printf("target [%v], workload [%v], distribution [%v], records [%v], operations [%v], clients [%v]\n",
+		*targetKind, *workloadName, config.distribution, config.records, config.operations, config.clients)
+	if err := bench(target, config); err != nil {
+		log.Printf("benchmark failed with error [%v]\n", err)
+	}
+}
+
+func bench(target ITarget, config tBenchConfig) error {
+	clients := make([]*tClient, config.clients)
+	for i := range clients {
+		session, err := target.Session()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		rng := rand.New(rand.NewSource(config.seed + int64(i)))
+		offset := config.records * int64(i) / int64(config.clients)
+		chooser, err := makeKeyChooser(config.distribution, rng, config.records, config.zipfExponent, offset)
+		if err != nil {
+			return err
+		}
+		clients[i] = &tClient{session: session, rng: rng, chooser: chooser, latencies: &tLatencies{}}
+	}
+
+	if config.workload.scan > 0 {
+		if _, err := clients[0].session.Scan(nil, 1); errors.Is(err, errScanNotSupported) {
+			return err
+		}
+	}
+	start := time.Now()
+	if err := load(clients, config); err != nil {
+		return err
+	}
+	fmt.Printf("load: [%v] records in [%v]\n", config.records, time.Since(start).Round(time.Millisecond))
+
+	var before storage.TStorageStatistics
+	if stats := target.Statistics(); stats != nil {
+		before = *stats
+	}
+	inserted := &atomic.Int64{}
+	inserted.Store(config.records)
+	putBytes := &atomic.Int64{}
+	wg := &sync.WaitGroup{}
+	start = time.Now()
+	for i, client := range clients {
+		operations := config.operations / int64(config.clients)
+		if int64(i) < config.operations%int64(config.clients) {
+			operations++
+		}
+		wg.Add(1)
+		go func(client *tClient, operations int64) {
+			defer wg.Done()
+			client.run(config, operations, inserted, putBytes)
+		}(client, operations)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &tLatencies{}
+	for _, client := range clients {
+		total.merge(client.latencies)
+	}
+	report(total, elapsed, config.operations)
+	if stats := target.Statistics(); stats != nil {
+		reportIO(before, *stats, config.operations, putBytes.Load())
+	}
+	return nil
+}
+
+// clients insert interleaved ranges of record ids, so sequential keys arrive in order
+func load(clients []*tClient, config tBenchConfig) error {
+	errs := make(chan error, len(clients))
+	wg := &sync.WaitGroup{}
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *tClient) {
+			defer wg.Done()
+			for id := int64(i); id < config.records; id += int64(len(clients)) {
+				value := randomValue(client.rng, config.valueSize)
+				if err := client.session.Put(recordKey(id, config.distribution), value); err != nil {
+					errs <- fmt.Errorf("failed to load record [%v], error [%w]", id, err)
+					return
+				}
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (c *tClient) run(config tBenchConfig, operations int64, inserted, putBytes *atomic.Int64) {
+	for op := int64(0); op < operations; op++ {
+		kind := config.workload.next(c.rng)
+		var (
+			key []byte
+			err error
+		)
+		if kind == opInsert {
+			key = recordKey(inserted.Add(1)-1, config.distribution)
+		} else {
+			key = recordKey(c.chooser.next(inserted.Load()), config.distribution)
+		}
+		var value []byte
+		if kind == opInsert || kind == opUpdate {
+			value = randomValue(c.rng, config.valueSize)
+			putBytes.Add(int64(len(key) + len(value)))
+		}
+		scanLength := c.rng.Intn(config.scanLength) + 1
+		start := time.Now()
+		switch kind {
+		case opRead:
+			_, err = c.session.Get(key)
+		case opUpdate, opInsert:
+			err = c.session.Put(key, value)
+		case opScan:
+			_, err = c.session.Scan(key, scanLength)
+		}
+		c.latencies.durations[kind] = append(c.latencies.durations[kind], time.Since(start))
+		if errors.Is(err, btree.ErrNotFound) {
+			c.latencies.notFound[kind]++
+		} else if err != nil {
+			if c.latencies.errors[kind] == 0 {
+				log.Printf("%v failed with error [%v]\n", opNames[kind], err)
+			}
+			c.latencies.errors[kind]++
+		}
+	}
+}
+
+func report(latencies *tLatencies, elapsed time.Duration, operations int64) {
+	fmt.Printf("run: [%v] operations in [%v], throughput [%.1f] ops/s\n", operations, elapsed.Round(time.Millisecond), float64(operations)/elapsed.Seconds())
+	fmt.Printf("%-8s %10s %8s %10s %12s %12s %12s %12s %12s\n", "op", "count", "errors", "not found", "p50", "p95", "p99", "p99.9", "max")
+	for kind, durations := range latencies.durations {
+		if len(durations) == 0 {
+			continue
+		}
+		sortDurations(durations)
+		fmt.Printf("%-8s %10d %8d %10d %12v %12v %12v %12v %12v\n", opNames[kind], len(durations), latencies.errors[kind], latencies.notFound[kind],
+			percentile(durations, 0.5), percentile(durations, 0.95), percentile(durations, 0.99), percentile(durations, 0.999), durations[len(durations)-1])
+	}
+}
+
+// amplification relates bytes written to the storage to bytes of keys and values put by clients
+func reportIO(before, after storage.TStorageStatistics, operations, putBytes int64) {
+	perOp := func(delta uint64) float64 {
+		return float64(delta) / float64(operations)
+	}
+	fmt.Printf("io per operation: read calls [%.2f], bytes read [%.1f], write calls [%.2f], bytes written [%.1f]\n",
+		perOp(after.ReadCalls-before.ReadCalls), perOp(after.BytesRead-before.BytesRead),
+		perOp(after.WriteCalls-before.WriteCalls), perOp(after.BytesWritten-before.BytesWritten))
+	if lookups := (after.CacheHits - before.CacheHits) + (after.CacheMisses - before.CacheMisses); lookups > 0 {
+		fmt.Printf("buffer pool: hit ratio [%.3f], evictions per operation [%.2f]\n",
+			float64(after.CacheHits-before.CacheHits)/float64(lookups), perOp(after.Evictions-before.Evictions))
+	}
+	if logCalls := after.LogWriteCalls - before.LogWriteCalls; logCalls > 0 {
+		fmt.Printf("write-ahead log: appends per operation [%.2f], bytes per operation [%.1f]\n",
+			perOp(logCalls), perOp(after.LogBytesWritten-before.LogBytesWritten))
+	}
+	if compressed := after.CompressedPages - before.CompressedPages; compressed > 0 {
+		fmt.Printf("compressed page writes per operation [%.2f]\n", perOp(compressed))
+	}
+	if failures := after.PunchFailures - before.PunchFailures; failures > 0 {
+		fmt.Printf("compressed pages left unpunched [%v]\n", failures)
+	}
+	if syncs := after.SyncCalls - before.SyncCalls; syncs > 0 {
+		fmt.Printf("syncs per operation [%.3f]\n", perOp(syncs))
+	}
+	if putBytes > 0 {
+		fmt.Printf("write amplification [%.2f]\n", float64(after.BytesWritten-before.BytesWritten)/float64(putBytes))
+	}
+}
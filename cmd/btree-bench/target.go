@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+// a tree under test, every client gets its own session
+type ITarget interface {
+	Session() (ISession, error)
+	// nil when the target does not expose storage statistics
+	Statistics() *storage.TStorageStatistics
+	Close() error
+}
+
+type ISession interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	// returns the number of visited keys
+	Scan(start []byte, count int) (int, error)
+	Close() error
+}
+
+var errScanNotSupported = errors.New("scans are not supported by the target")
+
+/******************* EMBEDDED *******************/
+type tEmbeddedTarget struct {
+	tree    btree.IBTree
+	strg    storage.INodeStorage
+	path    string
+	keepDb  bool
+	session *tEmbeddedSession
+}
+
+type tEmbeddedSession struct {
+	tree btree.IBTree
+}
+
+func makeEmbeddedTarget(config storage.TConfig, mode string, redistribute, keepDb bool) (*tEmbeddedTarget, error) {
+	path := config.FilePath
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("file [%v] already exists, every run starts with an empty tree", path)
+	}
+	strg, err := storage.MakeNodeStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	var tree btree.IBTree
+	switch mode {
+	case "paged":
+		config := btree.TConfig{MaxKeysCount: strg.Config().MaxCellsCount, Redistribute: redistribute}
+		if paged := btree.MakePagedBTreeWithConfig(strg, config); paged != nil {
+			tree = paged
+		}
+	case "buffered":
+		if buffered := btree.MakeBufferedBTree(strg); buffered != nil {
+			tree = buffered
+		}
+	}
+	if tree == nil {
+		strg.Close()
+		return nil, fmt.Errorf("failed to create a tree of mode [%v]", mode)
+	}
+	return &tEmbeddedTarget{tree: tree, strg: strg, path: path, keepDb: keepDb, session: &tEmbeddedSession{tree: tree}}, nil
+}
+
+func (t *tEmbeddedTarget) Session() (ISession, error) {
+	return t.session, nil
+}
+
+func (t *tEmbeddedTarget) Statistics() *storage.TStorageStatistics {
+	return t.strg.Statistics()
+}
+
+func (t *tEmbeddedTarget) Close() error {
+	err := t.strg.Close()
+	if !t.keepDb {
+		os.Remove(t.path)
+		os.Remove(t.path + ".wal")
+	}
+	return err
+}
+
+func (s *tEmbeddedSession) Get(key []byte) ([]byte, error) {
+	return s.tree.Get(key)
+}
+
+func (s *tEmbeddedSession) Put(key, value []byte) error {
+	return s.tree.Put(key, value)
+}
+
+func (s *tEmbeddedSession) Scan(start []byte, count int) (int, error) {
+	scanner, ok := s.tree.(btree.IScanner)
+	if !ok {
+		return 0, errScanNotSupported
+	}
+	visited := 0
+	err := scanner.Scan(start, nil, func(key, value []byte) bool {
+		visited++
+		return visited < count
+	})
+	return visited, err
+}
+
+func (s *tEmbeddedSession) Close() error {
+	return nil
+}
+
+/******************* SERVER *******************/
+const protocolVersion = 1
+
+// every session holds a connection, which occupies one of the server workers
+type tServerTarget struct {
+	addr string
+}
+
+type tServerSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (t *tServerTarget) Session() (ISession, error) {
+	conn, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{protocolVersion}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &tServerSession{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (t *tServerTarget) Statistics() *storage.TStorageStatistics {
+	return nil
+}
+
+func (t *tServerTarget) Close() error {
+	return nil
+}
+
+func (s *tServerSession) Get(key []byte) ([]byte, error) {
+	if _, err := s.conn.Write(encodeMessage('g', key)); err != nil {
+		return nil, err
+	}
+	return s.readResponse()
+}
+
+/*
+Puts are not acknowledged, so a put is followed by a get of the same key and completes with its response.
+A failed put is only detected when the key was missing before.
+*/
+func (s *tServerSession) Put(key, value []byte) error {
+	request := append(encodeMessage('p', key, value), encodeMessage('g', key)...)
+	if _, err := s.conn.Write(request); err != nil {
+		return err
+	}
+	if _, err := s.readResponse(); err != nil {
+		return fmt.Errorf("put of [%s] is not applied, error [%w]", key, err)
+	}
+	return nil
+}
+
+func (s *tServerSession) Scan(start []byte, count int) (int, error) {
+	return 0, errScanNotSupported
+}
+
+func (s *tServerSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *tServerSession) readResponse() ([]byte, error) {
+	response, err := s.reader.ReadBytes('$')
+	if err != nil {
+		return nil, err
+	}
+	switch response[0] {
+	case 's':
+		return response[1 : len(response)-1], nil
+	case 'n':
+		return nil, btree.ErrNotFound
+	default:
+		return nil, fmt.Errorf("server responded with [%q]", response)
+	}
+}
+
+func encodeMessage(command byte, payloads ...[]byte) []byte {
+	message := []byte{command}
+	for i, payload := range payloads {
+		if i > 0 {
+			message = append(message, ',')
+		}
+		for _, ch := range payload {
+			if ch == '$' || ch == ',' || ch == '\\' {
+				message = append(message, '\\')
+			}
+			message = append(message, ch)
+		}
+	}
+	return append(message, '$')
+}
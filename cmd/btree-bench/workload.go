@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type tOpKind int
+
+const (
+	opRead tOpKind = iota
+	opUpdate
+	opInsert
+	opScan
+	opKindsCount
+)
+
+var opNames = [opKindsCount]string{"read", "update", "insert", "scan"}
+
+// shares of operation kinds, YCSB workloads B, A, E and a load-only one
+type tWorkload struct {
+	read, update, insert, scan float64
+}
+
+var workloads = map[string]tWorkload{
+	"read-heavy":   {read: 0.95, update: 0.05},
+	"update-heavy": {read: 0.5, update: 0.5},
+	"scan-heavy":   {scan: 0.95, insert: 0.05},
+	"insert-only":  {insert: 1},
+}
+
+func (w tWorkload) next(rng *rand.Rand) tOpKind {
+	x := rng.Float64()
+	if x < w.read {
+		return opRead
+	}
+	if x < w.read+w.update {
+		return opUpdate
+	}
+	if x < w.read+w.update+w.insert {
+		return opInsert
+	}
+	return opScan
+}
+
+// picks one of count existing records
+type IKeyChooser interface {
+	next(count int64) int64
+}
+
+type tUniformChooser struct {
+	rng *rand.Rand
+}
+
+// low record ids are the most popular ones, keys of records are hashed, so popular keys are spread over the tree
+type tZipfianChooser struct {
+	zipf *rand.Zipf
+}
+
+// each client walks through the records starting from its own offset
+type tSequentialChooser struct {
+	position int64
+}
+
+func makeKeyChooser(distribution string, rng *rand.Rand, records int64, exponent float64, offset int64) (IKeyChooser, error) {
+	switch distribution {
+	case "uniform":
+		return &tUniformChooser{rng: rng}, nil
+	case "zipfian":
+		if exponent <= 1 {
+			return nil, fmt.Errorf("zipf exponent must be greater than 1, got [%v]", exponent)
+		}
+		return &tZipfianChooser{zipf: rand.NewZipf(rng, exponent, 1, uint64(records-1))}, nil
+	case "sequential":
+		return &tSequentialChooser{position: offset}, nil
+	}
+	return nil, fmt.Errorf("unknown distribution [%v]", distribution)
+}
+
+func (c *tUniformChooser) next(count int64) int64 {
+	return c.rng.Int63n(count)
+}
+
+func (c *tZipfianChooser) next(count int64) int64 {
+	return int64(c.zipf.Uint64() % uint64(count))
+}
+
+func (c *tSequentialChooser) next(count int64) int64 {
+	id := c.position % count
+	c.position = id + 1
+	return id
+}
+
+// keys are ordered as record ids for sequential runs and hashed otherwise, as YCSB does
+func recordKey(id int64, distribution string) []byte {
+	if distribution == "sequential" {
+		return []byte(fmt.Sprintf("user%012d", id))
+	}
+	hash := fnv.New64a()
+	hash.Write(binary.BigEndian.AppendUint64(nil, uint64(id)))
+	return []byte(fmt.Sprintf("user%020d", hash.Sum64()))
+}
+
+// printable, so values pass through the telnet mode of the server unchanged
+func randomValue(rng *rand.Rand, size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = letters[rng.Intn(len(letters))]
+	}
+	return value
+}
+
+type tLatencies struct {
+	durations [opKindsCount][]time.Duration
+	errors    [opKindsCount]int
+	notFound  [opKindsCount]int
+}
+
+func (l *tLatencies) merge(other *tLatencies) {
+	for kind := range l.durations {
+		l.durations[kind] = append(l.durations[kind], other.durations[kind]...)
+		l.errors[kind] += other.errors[kind]
+		l.notFound[kind] += other.notFound[kind]
+	}
+}
+
+// nearest rank percentile of sorted durations, p is in (0, 1]
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func sortDurations(durations []time.Duration) {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyChoosers(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, distribution := range []string{"uniform", "zipfian", "sequential"} {
+		chooser, err := makeKeyChooser(distribution, rng, 100, 1.1, 95)
+		require.Empty(t, err)
+		hits := make([]int, 100)
+		for i := 0; i < 10000; i++ {
+			id := chooser.next(100)
+			require.True(t, id >= 0 && id < 100, "distribution [%v], id [%v]", distribution, id)
+			hits[id]++
+		}
+		switch distribution {
+		case "uniform":
+			require.InDelta(t, 100, hits[0], 50)
+		case "zipfian":
+			require.Greater(t, hits[0], hits[50]*10)
+		case "sequential":
+			require.Equal(t, 100, hits[0])
+		}
+	}
+	_, err := makeKeyChooser("zipfian", rng, 100, 1, 0)
+	require.NotEmpty(t, err)
+	require.Equal(t, -1, bytes.Compare(recordKey(9, "sequential"), recordKey(10, "sequential")))
+}
+
+func TestPercentile(t *testing.T) {
+	durations := []time.Duration{5, 1, 4, 2, 3}
+	sortDurations(durations)
+	require.Equal(t, time.Duration(3), percentile(durations, 0.5))
+	require.Equal(t, time.Duration(5), percentile(durations, 0.99))
+	require.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
+
+func TestEncodeMessage(t *testing.T) {
+	require.Equal(t, []byte(`pa\,b,c\$d\\$`), encodeMessage('p', []byte("a,b"), []byte(`c$d\`)))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/vladem/btree/btree"
 	"github.com/vladem/btree/server"
@@ -11,24 +12,87 @@ import (
 
 func main() {
 	path := flag.String("path", "./db", "path to a file to persist data")
+	pageSize := flag.Uint("page-size", 1024, "page size of a new file, an existing file keeps its own")
+	compress := flag.Bool("compress", false, "compress pages with flate and punch the freed blocks out of the file, takes pages of 8KB or more")
+	maxKeys := flag.Uint("max-keys", 11, "max keys in a node (odd), 0 to split nodes by page bytes")
+	redistribute := flag.Bool("redistribute", false, "shift keys to siblings before splitting leaves")
+	poolBytes := flag.Uint("pool-bytes", 0, "budget of the page buffer pool, 0 to write every change immediately")
+	wal := flag.Bool("wal", false, "log every operation to a write-ahead log next to the file, replayed after a crash")
+	mmap := flag.Bool("mmap", false, "decode nodes from a memory mapping of the file instead of reading pages")
+	copyOnWrite := flag.Bool("cow", false, "write changed nodes to new pages and switch the root on commit, excludes -pool-bytes and -wal")
+	migrate := flag.Bool("migrate", false, "rewrite an existing file in the current layout with page checksums before serving")
+	repairFreeList := flag.Bool("repair-free-list", false, "chain free pages again from the page flags before serving, for a damaged chain")
+	compact := flag.Bool("compact", false, "move nodes into free pages and shrink the file before serving")
+	mode := flag.String("mode", "paged", "tree implementation, 'paged' or 'buffered' (requires max-keys 0)")
+	durability := flag.String("durability", "none", "when puts are synced, 'none', 'sync' (every put), 'timer' or 'group' (concurrent puts share a sync, requires -pool-bytes and -wal)")
+	syncInterval := flag.Duration("sync-interval", time.Second, "period of syncs with -durability timer")
+	keyFile := flag.String("key-file", "", "file holding a hex encoded AES key, encrypts a new file, required to open an encrypted one")
 	flag.Parse()
 
-	maxKeysCount := uint32(11)
-	config := storage.TConfig{PageSizeBytes: 1024, FilePath: *path, MaxCellsCount: maxKeysCount}
+	cfg := server.ServerConfig{
+		Port:         "8080",
+		Workers:      2,
+		TelnetMode:   true,
+		SyncInterval: *syncInterval,
+	}
+	var err error
+	if cfg.Durability, err = storage.ParseDurability(*durability); err != nil {
+		log.Fatalf("failed to parse durability with error [%v]\n", err)
+	}
+	maxKeysCount := uint32(*maxKeys)
+	config := cfg.StorageConfig(storage.TConfig{
+		PageSizeBytes:   uint32(*pageSize),
+		FilePath:        *path,
+		MaxCellsCount:   maxKeysCount,
+		BufferPoolBytes: uint32(*poolBytes),
+		WriteAheadLog:   *wal,
+		CopyOnWrite:     *copyOnWrite,
+		MemoryMapped:    *mmap,
+	})
+	if *compress {
+		config.PageCodec = storage.CodecFlate
+	}
+	if *keyFile != "" {
+		config.KeyProvider = storage.MakeFileKeyProvider(*keyFile)
+	}
+	if *migrate {
+		if err := storage.Migrate(config); err != nil {
+			log.Fatalf("failed to migrate storage with error [%v]\n", err)
+		}
+	}
+	if *repairFreeList {
+		if err := storage.RepairFreeList(config); err != nil {
+			log.Fatalf("failed to repair free list with error [%v]\n", err)
+		}
+	}
 	strg, err := storage.MakeNodeStorage(config)
 	if err != nil {
 		log.Fatalf("failed to create storage with error [%v]\n", err)
 	}
 	defer strg.Close()
-	tree := btree.MakePagedBTree(strg, maxKeysCount)
+	if *compact {
+		reclaimed, err := strg.Compact()
+		if err != nil {
+			log.Fatalf("failed to compact storage with error [%v]\n", err)
+		}
+		log.Printf("compaction reclaimed [%v] bytes\n", reclaimed)
+	}
+	// an existing file keeps the cells count it was created with
+	maxKeysCount = strg.Config().MaxCellsCount
+	var tree btree.IBTree
+	switch *mode {
+	case "paged":
+		if paged := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{MaxKeysCount: maxKeysCount, Redistribute: *redistribute}); paged != nil {
+			tree = paged
+		}
+	case "buffered":
+		if buffered := btree.MakeBufferedBTree(strg); buffered != nil {
+			tree = buffered
+		}
+	}
 	if tree == nil {
 		log.Fatalf("failed to create a tree\n")
 	}
-	cfg := server.ServerConfig{
-		Port:       "8080",
-		Workers:    2,
-		TelnetMode: true,
-	}
 	server, err := server.MakeServer(cfg, tree)
 	if err != nil {
 		log.Fatalf("failed to create server with error [%v]\n", err)
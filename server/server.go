@@ -1,19 +1,27 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
 )
 
 type ServerConfig struct {
 	Port       string
 	Workers    uint16
 	TelnetMode bool
+	// policy of the storage of the tree, applied to the storage config by StorageConfig
+	Durability storage.TDurability
+	// period of storage.DurabilityTimer, 0 means 1 second
+	SyncInterval time.Duration
 }
 
 // Simple tcp server, which implements the following protocol:
@@ -29,8 +37,8 @@ type ServerConfig struct {
 //   - variable size: value [byte array]
 //
 // get produces a response:
-// - 1 byte: success/fail [uint8] ('s' - success, 'f' - fail)
-// - variable size: value [byte array]
+// - 1 byte: result [uint8] ('s' - success, 'n' - key not found, 'f' - failure)
+// - variable size: value [byte array], only on success, may be empty
 //
 // messages of all types are terminated with '$'
 type Server struct {
@@ -41,11 +49,14 @@ type Server struct {
 
 type worker struct {
 	wid    uint16
-	logger log.Logger
+	logger *log.Logger
 	server *Server
 }
 
 func MakeServer(cfg ServerConfig, bTree btree.IBTree) (*Server, error) {
+	if cfg.Durability > storage.DurabilityGroupCommit {
+		return nil, fmt.Errorf("unknown durability [%v]", cfg.Durability)
+	}
 	ln, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on port [%s] with error [%v]", cfg.Port, err)
@@ -54,32 +65,60 @@ func MakeServer(cfg ServerConfig, bTree btree.IBTree) (*Server, error) {
 	return &server, nil
 }
 
+// the storage of the served tree is opened with the returned config, so puts are acknowledged with the policy of the server
+func (cfg ServerConfig) StorageConfig(config storage.TConfig) storage.TConfig {
+	config.Durability = cfg.Durability
+	config.SyncInterval = cfg.SyncInterval
+	return config
+}
+
 func makeWorker(wid uint16, server *Server) *worker {
 	logger := log.New(log.Default().Writer(), fmt.Sprintf("worker [%d]: ", wid), 0)
-	w := worker{wid: wid, logger: *logger, server: server}
+	w := worker{wid: wid, logger: logger, server: server}
 	return &w
 }
 
+// operations in flight are cancelled once cancel is signalled, returns after the connections are closed
 func (s *Server) Serve(cancel chan struct{}) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var workers sync.WaitGroup
 	for i := uint16(0); i < s.cfg.Workers; i++ {
 		w := makeWorker(i, s)
-		go w.doWork()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			w.doWork(ctx)
+		}()
 	}
 	<-cancel
+	stop()
 	err := (*s.listener).Close()
+	workers.Wait()
 	if err != nil {
 		return fmt.Errorf("failed to close listener on port [%s] with error [%v]", s.cfg.Port, err)
 	}
 	return nil
 }
 
-func (w *worker) handleConnection(conn *net.Conn) {
+/*
+The connection is read in a separate goroutine, so operations are cancelled as soon as reading fails
+or the server is stopped. A client closing the connection cleanly gets the messages it sent handled.
+Stopping the server expires reads, so idle clients do not keep the connection open.
+*/
+func (w *worker) handleConnection(ctx context.Context, conn *net.Conn) {
 	defer (*conn).Close()
 	var (
 		version = make([]byte, 1)
-		chunk   = make([]byte, 64)
 		decoder = makeDecoder(w.server.cfg.TelnetMode)
+		chunks  = make(chan []byte)
 	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		(*conn).SetReadDeadline(time.Now())
+	}()
 	read, err := (*conn).Read(version)
 	if err != nil || read != 1 {
 		w.logger.Printf("failed to read version with error [%v], read [%d] bytes", err, read)
@@ -87,48 +126,74 @@ func (w *worker) handleConnection(conn *net.Conn) {
 	} else {
 		w.logger.Printf("protocol version is %v", version[0])
 	}
-	for {
-		read, err := (*conn).Read(chunk)
-		if err != nil && !errors.Is(err, io.EOF) {
-			w.logger.Printf("failed to read with error [%v]", err)
-		}
-		if err != nil {
-			break
-		}
-		decoder.consume(chunk[:read])
-		for decoder.hasNext() {
-			next := decoder.next()
-			w.logger.Printf("received msg, type: %d, data: %v", next.commandType, next.payloads)
-			if next.commandType == commandTypeGet {
-				getM, err := next.ToGetMessage()
-				if err != nil {
-					w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
-					continue
+	go func() {
+		defer close(chunks)
+		for {
+			chunk := make([]byte, 64)
+			read, err := (*conn).Read(chunk)
+			if read > 0 {
+				select {
+				case chunks <- chunk[:read]:
+				case <-ctx.Done():
+					return
 				}
-				val, _ := w.server.bTree.Get(getM.key)
-				result := []byte{'f'}
-				if val != nil {
-					result[0] = 's'
-					result = append(result, val...)
-				}
-				result = append(result, '$')
-				(*conn).Write(result)
-			} else if next.commandType == commandTypePut {
-				putM, err := next.ToPutMessage()
-				if err != nil {
-					w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
-					continue
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					w.logger.Printf("failed to read with error [%v]", err)
 				}
-				w.server.bTree.Put(putM.key, putM.value)
-			} else {
-				w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
+				cancel()
+				return
 			}
 		}
+	}()
+	for chunk := range chunks {
+		decoder.consume(chunk)
+		for decoder.hasNext() {
+			w.handleMessage(ctx, conn, decoder.next())
+		}
 	}
 	w.logger.Printf("connection [%s/%s] will be closed", (*conn).LocalAddr().String(), (*conn).RemoteAddr().String())
 }
 
-func (w *worker) doWork() {
+func (w *worker) handleMessage(ctx context.Context, conn *net.Conn, next *message) {
+	w.logger.Printf("received msg, type: %d, data: %v", next.commandType, next.payloads)
+	if next.commandType == commandTypeGet {
+		getM, err := next.ToGetMessage()
+		if err != nil {
+			w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
+			return
+		}
+		val, err := w.server.bTree.GetContext(ctx, getM.key)
+		result := []byte{responseSuccess}
+		if errors.Is(err, btree.ErrNotFound) {
+			result[0] = responseNotFound
+		} else if err != nil {
+			w.logger.Printf("get failed with error [%v]", err)
+			result[0] = responseFailure
+		} else {
+			result = append(result, val...)
+		}
+		result = append(result, '$')
+		(*conn).Write(result)
+	} else if next.commandType == commandTypePut {
+		putM, err := next.ToPutMessage()
+		if err != nil {
+			w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
+			return
+		}
+		if err := w.server.bTree.PutContext(ctx, putM.key, putM.value); err != nil {
+			w.logger.Printf("put failed with error [%v]", err)
+		}
+	} else {
+		w.logger.Printf("invalid msg, type: %d, data: %v", next.commandType, next.payloads)
+	}
+}
+
+func (w *worker) doWork(ctx context.Context) {
 	w.logger.Printf("started\n")
 	for {
 		conn, err := (*w.server.listener).Accept()
@@ -136,6 +201,6 @@ func (w *worker) doWork() {
 			log.Printf("failed to accept connection with error [%v]\n", err)
 			break
 		}
-		w.handleConnection(&conn)
+		w.handleConnection(ctx, &conn)
 	}
 }
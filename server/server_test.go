@@ -1,12 +1,20 @@
 package server_test
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vladem/btree/btree"
 	"github.com/vladem/btree/server"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
 )
 
 func createServer(t *testing.T, port string) chan struct{} {
@@ -50,3 +58,213 @@ func TestServerSimpleGet(t *testing.T) {
 	assert.Equal(t, []byte{'s', 'b', '$'}, buf[0:3])
 	cancel <- struct{}{}
 }
+
+// blocks in Get until the context is cancelled
+type tBlockingBTree struct {
+	*btree.TDummyBTree
+	started   chan struct{}
+	cancelled chan error
+}
+
+func makeBlockingBTree() *tBlockingBTree {
+	return &tBlockingBTree{TDummyBTree: btree.MakeDummyBTree(), started: make(chan struct{}, 1), cancelled: make(chan error, 1)}
+}
+
+func (bt *tBlockingBTree) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	bt.started <- struct{}{}
+	<-ctx.Done()
+	bt.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// a connection reset by the client cancels the operation in flight
+func TestServerCancelsOnReset(t *testing.T) {
+	port := "8081"
+	tree := makeBlockingBTree()
+	server, err := server.MakeServer(server.ServerConfig{Port: port, Workers: 1, TelnetMode: true}, tree)
+	if err != nil {
+		t.Fatalf("failed to create server with error [%v]\n", err)
+	}
+	cancel := make(chan struct{})
+	go server.Serve(cancel)
+	defer func() { cancel <- struct{}{} }()
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	writeAndCheck(t, &conn, []byte{1 /* version */, 'g' /* get */, 'a' /* key */, '$'})
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	select {
+	case err := <-tree.cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("get was not cancelled")
+	}
+}
+
+func TestServerMissingAndEmpty(t *testing.T) {
+	port := "8082"
+	cancel := createServer(t, port)
+	defer func() { cancel <- struct{}{} }()
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	defer conn.Close()
+	writeAndCheck(t, &conn, []byte{1 /* version */, 'p' /* put */, 'a' /* key */, ',', '$'})
+	writeAndCheck(t, &conn, []byte{'g' /* get */, 'a' /* key */, '$'})
+	writeAndCheck(t, &conn, []byte{'g' /* get */, 'b' /* key */, '$'})
+	expected := []byte{'s', '$', 'n', '$'}
+	buf := make([]byte, 64)
+	read := 0
+	for read < len(expected) {
+		n, err := conn.Read(buf[read:])
+		if err != nil {
+			t.Fatalf("failed to read with error [%v]\n", err)
+		}
+		read += n
+	}
+	assert.Equal(t, expected, buf[:read])
+}
+
+// stopping the server cancels the operation in flight
+func TestServerCancelsOnStop(t *testing.T) {
+	port := "8083"
+	tree := makeBlockingBTree()
+	server, err := server.MakeServer(server.ServerConfig{Port: port, Workers: 1, TelnetMode: true}, tree)
+	if err != nil {
+		t.Fatalf("failed to create server with error [%v]\n", err)
+	}
+	cancel := make(chan struct{})
+	go server.Serve(cancel)
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	defer conn.Close()
+	writeAndCheck(t, &conn, []byte{1 /* version */, 'g' /* get */, 'a' /* key */, '$'})
+	<-tree.started
+	cancel <- struct{}{}
+	select {
+	case err := <-tree.cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("get was not cancelled")
+	}
+}
+
+// messages sent before the client closed the connection are handled
+func TestServerFinishesOnClose(t *testing.T) {
+	port := "8084"
+	tree := btree.MakeDummyBTree()
+	server, err := server.MakeServer(server.ServerConfig{Port: port, Workers: 1, TelnetMode: true}, tree)
+	if err != nil {
+		t.Fatalf("failed to create server with error [%v]\n", err)
+	}
+	cancel := make(chan struct{})
+	go server.Serve(cancel)
+	defer func() { cancel <- struct{}{} }()
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	puts := 2000
+	data := []byte{1 /* version */}
+	for i := 0; i < puts; i++ {
+		data = append(data, []byte(fmt.Sprintf("pkey%04d,value$", i))...)
+	}
+	writeAndCheck(t, &conn, data)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		stored := 0
+		tree.Scan(nil, nil, func(key, value []byte) bool {
+			stored++
+			return true
+		})
+		return stored == puts
+	}, 5*time.Second, time.Millisecond)
+}
+
+// stopping the server closes connections of idle clients, including ones which sent no version yet
+func TestServerStopsWithIdleClients(t *testing.T) {
+	port := "8085"
+	server, err := server.MakeServer(server.ServerConfig{Port: port, Workers: 2, TelnetMode: true}, btree.MakeDummyBTree())
+	if err != nil {
+		t.Fatalf("failed to create server with error [%v]\n", err)
+	}
+	cancel := make(chan struct{})
+	served := make(chan error)
+	go func() { served <- server.Serve(cancel) }()
+	silent, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	defer silent.Close()
+	idle, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	defer idle.Close()
+	writeAndCheck(t, &idle, []byte{1 /* version */, 'p' /* put */, 'a' /* key */, ',', 'b' /* value */, '$'})
+	writeAndCheck(t, &idle, []byte{'g' /* get */, 'a' /* key */, '$'})
+	buf := make([]byte, 64)
+	n, err := idle.Read(buf)
+	assert.Empty(t, err)
+	assert.Equal(t, []byte{'s', 'b', '$'}, buf[:n])
+	cancel <- struct{}{}
+	select {
+	case err := <-served:
+		assert.Empty(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	for _, conn := range []net.Conn{silent, idle} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	}
+}
+
+// puts acknowledged by a server with DurabilitySync are synced by the storage it configured
+func TestServerDurability(t *testing.T) {
+	port := "8086"
+	cfg := server.ServerConfig{Port: port, Workers: 1, TelnetMode: true, Durability: 7}
+	_, err := server.MakeServer(cfg, btree.MakeDummyBTree())
+	assert.Error(t, err)
+
+	cfg.Durability = storage.DurabilitySync
+	config := cfg.StorageConfig(storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + util.TimeBasedFileName()})
+	assert.Equal(t, storage.DurabilitySync, config.Durability)
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	if err != nil {
+		t.Fatalf("failed to create storage with error [%v]\n", err)
+	}
+	defer strg.Close()
+	srv, err := server.MakeServer(cfg, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}))
+	if err != nil {
+		t.Fatalf("failed to create server with error [%v]\n", err)
+	}
+	cancel := make(chan struct{})
+	go srv.Serve(cancel)
+	defer func() { cancel <- struct{}{} }()
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to connect to the server with error [%v]\n", err)
+	}
+	defer conn.Close()
+	puts := 20
+	data := []byte{1 /* version */}
+	for i := 0; i < puts; i++ {
+		data = append(data, []byte(fmt.Sprintf("pkey%02d,value$", i))...)
+	}
+	// the get is answered once the puts before it are done
+	data = append(data, []byte("gkey00$")...)
+	writeAndCheck(t, &conn, data)
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.Empty(t, err)
+	assert.Equal(t, []byte("svalue$"), buf[:n])
+	assert.GreaterOrEqual(t, atomic.LoadUint64(&strg.Statistics().SyncCalls), uint64(puts))
+}
@@ -16,6 +16,12 @@ var (
 	commandTypePut = uint8('p')
 )
 
+var (
+	responseSuccess  = byte('s')
+	responseNotFound = byte('n')
+	responseFailure  = byte('f')
+)
+
 type getMessage struct {
 	key []byte
 }
@@ -40,10 +46,11 @@ func createMessage(buffer []byte) *message {
 	buffer = buffer[1:]
 	for len(buffer) > 0 {
 		var (
-			ch      byte
-			readIdx = 0
-			escaped = false
-			part    = make([]byte, 0)
+			ch        byte
+			readIdx   = 0
+			escaped   = false
+			separated = false
+			part      = make([]byte, 0)
 		)
 		for readIdx, ch = range buffer {
 			if escaped {
@@ -52,11 +59,16 @@ func createMessage(buffer []byte) *message {
 				escaped = true
 				continue
 			} else if ch == ',' {
+				separated = true
 				break
 			}
 			part = append(part, ch)
 		}
 		message.payloads = append(message.payloads, part)
+		// a separator at the very end is followed by an empty payload
+		if separated && readIdx == len(buffer)-1 {
+			message.payloads = append(message.payloads, []byte{})
+		}
 		buffer = buffer[readIdx+1:]
 	}
 	return message
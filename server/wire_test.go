@@ -68,6 +68,26 @@ func TestCreateMessageEscapedPut(t *testing.T) {
 	assert.Equal(t, []byte{'\\', 'v', 'a', 'l'}, msg.payloads[1])
 }
 
+func TestCreateMessageEmptyValue(t *testing.T) {
+	buf := []byte{1, 'k', 'e', 'y', ','}
+	msg := createMessage(buf)
+	if msg == nil {
+		t.Fatal("msg is nil")
+	}
+	if len(msg.payloads) != 2 {
+		t.Fatalf("wrong msg.payloads: %v", msg.payloads)
+	}
+	assert.Equal(t, []byte{'k', 'e', 'y'}, msg.payloads[0])
+	assert.Equal(t, []byte{}, msg.payloads[1])
+
+	buf = []byte{1, 'k', 'e', 'y', '\\', ','}
+	msg = createMessage(buf)
+	if len(msg.payloads) != 1 {
+		t.Fatalf("wrong msg.payloads: %v", msg.payloads)
+	}
+	assert.Equal(t, []byte{'k', 'e', 'y', ','}, msg.payloads[0])
+}
+
 func TestConsumeSimple(t *testing.T) {
 	var (
 		decoder = makeDecoder(false)
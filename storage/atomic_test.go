@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
+)
+
+var errInjected = errors.New("injected write failure")
+
+type tTreeFactory func(strg storage.INodeStorage) btree.IBTree
+
+/*
+Fails the k-th write of a put for every k, until the put completes without reaching the fault.
+After every failure the file must be byte for byte the same and the tree must stay usable.
+*/
+func checkPutFailureAtomic(t *testing.T, config storage.TConfig, makeTree tTreeFactory) {
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := makeTree(strg)
+	keys, values := manyKeys(300)
+	util.ShuffleSliceBytes(keys)
+	for i := range keys {
+		values[i] = []byte(fmt.Sprintf("value of %s", keys[i]))
+	}
+	stored := 0
+	for ; stored < 200; stored++ {
+		require.Empty(t, tree.Put(keys[stored], values[stored]))
+	}
+	for ; stored < len(keys); stored++ {
+		for failAt := 1; ; failAt++ {
+			snapshot, err := os.ReadFile(config.FilePath)
+			require.Empty(t, err)
+			writes := 0
+			storage.SetWriteFault(strg, func(data []byte, offset int64) error {
+				writes++
+				if writes == failAt {
+					return errInjected
+				}
+				return nil
+			})
+			err = tree.Put(keys[stored], values[stored])
+			storage.SetWriteFault(strg, nil)
+			if err == nil {
+				break
+			}
+			require.ErrorIs(t, err, errInjected)
+			if config.BufferPoolBytes == 0 {
+				actual, err := os.ReadFile(config.FilePath)
+				require.Empty(t, err)
+				require.Equal(t, snapshot, actual, "put of [%s] failed at write [%v]", keys[stored], failAt)
+			} else {
+				// evicted pages of earlier puts may be written back, so only the content is compared
+				checkStored(t, tree, keys[:stored], values[:stored])
+			}
+			_, err = tree.Get(keys[stored])
+			require.ErrorIs(t, err, btree.ErrNotFound)
+		}
+	}
+	checkStored(t, tree, keys, values)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, makeTree(strg), keys, values)
+}
+
+func checkStored(t *testing.T, tree btree.IBTree, keys, values [][]byte) {
+	for i, key := range keys {
+		val, err := tree.Get(key)
+		require.Empty(t, err)
+		require.Equal(t, values[i], val)
+	}
+}
+
+func manyKeys(count int) ([][]byte, [][]byte) {
+	keys := make([][]byte, count)
+	values := make([][]byte, count)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i))
+	}
+	return keys, values
+}
+
+func TestPutFailureAtomicFixedCells(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + util.TimeBasedFileName(), MaxCellsCount: 5}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTree(strg, 5)
+	})
+}
+
+func TestPutFailureAtomicByteBudget(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + util.TimeBasedFileName()}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{Redistribute: true})
+	})
+}
+
+func TestPutFailureAtomicBuffered(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + util.TimeBasedFileName()}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakeBufferedBTree(strg)
+	})
+}
+
+func TestPutFailureAtomicBufferPool(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + util.TimeBasedFileName(), BufferPoolBytes: 256 * 8}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{Redistribute: true, AppendFastPath: true})
+	})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import "sort"
+
+/******************* PRIVATE *******************/
+/*
+Nodes saved by an operation are kept by it and written by the commit, so a node saved several times
+and the header changed by several allocations are written once. Pages are written whole in the order
+of ids and pages with consecutive ids are merged into a single write. A rollback drops the saved nodes,
+nothing of them reached the file.
+
+The buffer pool and copy-on-write keep saved nodes on their own, they only share the merged writes.
+*/
+const maxMergedWriteBytes = 1 << 20
+
+// false if the node is written right away, which is the case outside of operations
+func (s *tOnDiskNodeStorage) keepSaved(node *tNode) bool {
+	if s.undo == nil {
+		return false
+	}
+	if s.undo.saved == nil {
+		s.undo.saved = map[uint32]*tNode{}
+	}
+	s.undo.saved[node.id] = node
+	return true
+}
+
+// nil unless the operation in progress saved the node
+func (s *tOnDiskNodeStorage) savedNode(id uint32) *tNode {
+	if s.undo == nil {
+		return nil
+	}
+	return s.undo.saved[id]
+}
+
+// the page of a freed node gets its free page link instead
+func (s *tOnDiskNodeStorage) forgetSaved(id uint32) {
+	if s.undo != nil {
+		delete(s.undo.saved, id)
+	}
+}
+
+// the header of the copy-on-write file is switched by the commit on its own
+func (s *tOnDiskNodeStorage) deferHeader() bool {
+	if s.undo == nil || s.shadow != nil {
+		return false
+	}
+	s.undo.headerChanged = true
+	return true
+}
+
+// a run of pages with consecutive ids merged into a single write
+type tPageRun struct {
+	offset int64
+	data   []byte
+	nodes  []*tNode
+	used   []uint32
+}
+
+/*
+Called by the commit, a failure leaves the operation in progress to be rolled back. Every page and the header
+are logged before the first of them is written, so the log is synced once. With the buffer pool and the log
+nothing is written in place, so commits sync the log only as the durability policy requires.
+*/
+func (s *tOnDiskNodeStorage) writeSaved() error {
+	undo := s.undo
+	nodes := make([]*tNode, 0, len(undo.saved))
+	for _, node := range undo.saved {
+		nodes = append(nodes, node)
+	}
+	runs, err := s.mergePages(nodes)
+	if err != nil {
+		return err
+	}
+	var header []byte
+	// with the buffer pool and the log the header is logged by logCommit, as the dirty pages are
+	if undo.headerChanged && (s.pool == nil || s.wal == nil) {
+		header = s.encodeHeader()
+	}
+	for _, run := range runs {
+		if err := s.logChange(run.data, run.offset); err != nil {
+			return err
+		}
+	}
+	if header != nil {
+		if err := s.logChange(header, 0); err != nil {
+			return err
+		}
+	}
+	if err := s.writeRuns(runs, s.write); err != nil {
+		return err
+	}
+	undo.saved = nil
+	if header == nil {
+		return nil
+	}
+	undo.headerChanged = false
+	return s.write(header, 0)
+}
+
+func (s *tOnDiskNodeStorage) writePages(nodes []*tNode, write func([]byte, int64) error) error {
+	runs, err := s.mergePages(nodes)
+	if err != nil {
+		return err
+	}
+	return s.writeRuns(runs, write)
+}
+
+func (s *tOnDiskNodeStorage) mergePages(nodes []*tNode) ([]tPageRun, error) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	maxMerged := maxMergedWriteBytes / int(s.config.PageSizeBytes)
+	runs := []tPageRun{}
+	for start := 0; start < len(nodes); {
+		end := start + 1
+		for end < len(nodes) && end-start < maxMerged && nodes[end].id == nodes[end-1].id+1 {
+			end++
+		}
+		run := tPageRun{
+			offset: s.pageOffset(nodes[start].id),
+			data:   make([]byte, 0, (end-start)*int(s.config.PageSizeBytes)),
+			nodes:  nodes[start:end],
+			used:   make([]uint32, 0, end-start),
+		}
+		for _, node := range run.nodes {
+			page, pageUsed, err := s.physicalPage(node.id, node.encodePage())
+			if err != nil {
+				return nil, err
+			}
+			run.data = append(run.data, page...)
+			run.used = append(run.used, pageUsed)
+		}
+		runs = append(runs, run)
+		start = end
+	}
+	return runs, nil
+}
+
+func (s *tOnDiskNodeStorage) writeRuns(runs []tPageRun, write func([]byte, int64) error) error {
+	for _, run := range runs {
+		if err := write(run.data, run.offset); err != nil {
+			return err
+		}
+		for i, node := range run.nodes {
+			s.punchPage(node.id, run.used[i])
+			node.decoded = false
+		}
+	}
+	return nil
+}
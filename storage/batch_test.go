@@ -0,0 +1,57 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
+)
+
+// a put writes each page it touched once, the header only when it changed
+func TestWritesPerPut(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	before := *strg.Statistics()
+	require.Empty(t, tree.Put([]byte("key"), []byte("value")))
+	require.Equal(t, uint64(1), strg.Statistics().WriteCalls-before.WriteCalls)
+
+	keys, _ := manyKeys(2000)
+	util.ShuffleSliceBytes(keys)
+	before = *strg.Statistics()
+	for _, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+	}
+	perPut := float64(strg.Statistics().WriteCalls-before.WriteCalls) / float64(len(keys))
+	require.Less(t, perPut, 1.5)
+	checkStored(t, tree, keys, keys)
+}
+
+// pages with consecutive ids are written back by a single write
+func TestMergedWriteBack(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), BufferPoolBytes: 1024 * 1024}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(2000)
+	for _, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+	}
+	before := *strg.Statistics()
+	require.Empty(t, strg.Close())
+	written := strg.Statistics().BytesWritten - before.BytesWritten
+	require.Greater(t, written, uint64(10*config.PageSizeBytes))
+	require.Less(t, strg.Statistics().WriteCalls-before.WriteCalls, uint64(3))
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, keys)
+}
@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/storage"
+)
+
+func TestPageChecksum(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 10}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Equal(t, storage.FeatureChecksums|storage.FeatureFreeList|storage.FeatureKeyPrefixes, s1.Config().Features)
+	root := s1.RootNode()
+	root.InsertKeyValue([]byte("key"), []byte("value"), 0)
+	require.Empty(t, root.Save())
+	rootId := root.Id()
+	require.Empty(t, s1.Close())
+
+	// the cell is the last one of the page
+	data, err := os.ReadFile(filePath)
+	require.Empty(t, err)
+	data[64+1024*(rootId+1)-1] ^= 0x01
+	require.Empty(t, os.WriteFile(filePath, data, 0644))
+
+	_, err = storage.MakeNodeStorage(storage.TConfig{FilePath: filePath})
+	require.ErrorIs(t, err, storage.ErrCorrupted)
+	var pageErr *storage.TCorruptedPageError
+	require.True(t, errors.As(err, &pageErr))
+	require.Equal(t, rootId, pageErr.PageId)
+}
+
+// pages without checksums are still checked against their bounds
+func TestCorruptedSlot(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	raw := binary.BigEndian.AppendUint32(nil, 1) // layout version
+	raw = binary.BigEndian.AppendUint32(raw, 0)  // root node id
+	page := make([]byte, 1024)
+	page[0] = 0xc0                              // allocated leaf
+	binary.BigEndian.PutUint32(page[1:], 1)     // one cell
+	binary.BigEndian.PutUint32(page[5:], 1020)  // start of the cell
+	binary.BigEndian.PutUint32(page[9:], 1<<20) // end of the cell is out of the page
+	require.Empty(t, os.WriteFile(filePath, append(raw, page...), 0644))
+
+	_, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath})
+	var pageErr *storage.TCorruptedPageError
+	require.True(t, errors.As(err, &pageErr))
+	require.Equal(t, uint32(0), pageErr.PageId)
+}
+
+func TestMigrateLayoutVersion1(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	raw := binary.BigEndian.AppendUint32(nil, 1) // layout version
+	raw = binary.BigEndian.AppendUint32(raw, 0)  // root node id
+	page := make([]byte, 1024)
+	page[0] = 0xc0 // allocated leaf without cells
+	require.Empty(t, os.WriteFile(filePath, append(raw, page...), 0644))
+
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 10}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	root := s1.RootNode()
+	for i := 0; i < 10; i++ {
+		root.InsertKeyValue([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)), i)
+	}
+	require.Empty(t, root.Save())
+	require.Empty(t, s1.Close())
+
+	require.Empty(t, storage.Migrate(config))
+	// the page size is recorded in the header now
+	s2, err := storage.MakeNodeStorage(storage.TConfig{FilePath: filePath})
+	require.Empty(t, err)
+	require.Equal(t, storage.FeatureChecksums|storage.FeatureFreeList|storage.FeatureKeyPrefixes, s2.Config().Features)
+	require.Equal(t, uint32(10), s2.Config().MaxCellsCount)
+	root = s2.RootNode()
+	require.Equal(t, 10, root.KeyCount())
+	for i := 0; i < 10; i++ {
+		require.Equal(t, []byte(fmt.Sprintf("value%v", i)), root.Value(i))
+	}
+	require.Empty(t, s2.Close())
+
+	// migrating the current layout changes nothing
+	before, err := os.ReadFile(filePath)
+	require.Empty(t, err)
+	require.Empty(t, storage.Migrate(config))
+	after, err := os.ReadFile(filePath)
+	require.Empty(t, err)
+	require.Equal(t, before, after)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/******************* PUBLIC *******************/
+/*
+Moves nodes from the tail of the file into free pages, so the reachable nodes take the first pages,
+then truncates the file and returns the number of bytes it lost. Child ids of parents and the root id
+are updated, and every node is written with its cells packed at the end of the page.
+Compaction is a single operation, a failure rolls it back. Nodes loaded before it are stale afterwards,
+unless it moved them itself: saving a stale node fails with ErrStaleNode, so trees kept over the storage
+load their nodes again once Generation changes. It must not run concurrently with operations of the trees.
+Snapshots require copy-on-write, which compaction does not support.
+*/
+func (s *tOnDiskNodeStorage) Compact() (int64, error) {
+	if s.device == nil {
+		return 0, ErrClosed
+	}
+	if s.shadow != nil {
+		return 0, errors.New("compaction is not supported with copy-on-write")
+	}
+	if err := s.Begin(); err != nil {
+		return 0, err
+	}
+	s.generation++
+	sizeBefore := s.undo.fileSize
+	if err := s.compact(); err != nil {
+		if rollbackErr := s.Rollback(); rollbackErr != nil {
+			return 0, fmt.Errorf("%w, rollback failed with error [%v]", err, rollbackErr)
+		}
+		return 0, err
+	}
+	if err := s.Commit(); err != nil {
+		if rollbackErr := s.Rollback(); rollbackErr != nil {
+			return 0, fmt.Errorf("%w, rollback failed with error [%v]", err, rollbackErr)
+		}
+		return 0, err
+	}
+	s.compacted = s.generation
+	size, err := s.device.Size()
+	if err != nil {
+		return 0, err
+	}
+	return sizeBefore - size, nil
+}
+
+// raised by every compaction, nodes loaded at an older generation are stale
+func (s *tOnDiskNodeStorage) Generation() uint64 {
+	return s.compacted
+}
+
+/******************* PRIVATE *******************/
+func (s *tOnDiskNodeStorage) compact() error {
+	live, err := s.reachablePages()
+	if err != nil {
+		return err
+	}
+	// nodes beyond the first len(live) pages move to the free pages among them, in the order of ids
+	liveCount := uint32(len(live))
+	relocated := map[uint32]uint32{}
+	vacant := uint32(0)
+	for _, id := range live {
+		if id < liveCount {
+			continue
+		}
+		for s.isLive(live, vacant) {
+			vacant++
+		}
+		relocated[id] = vacant
+		vacant++
+	}
+	newId := func(id uint32) uint32 {
+		if moved, ok := relocated[id]; ok {
+			return moved
+		}
+		return id
+	}
+	rootId := s.rootNode.Id()
+	for _, id := range live {
+		node, err := s.loadForCompaction(id, rootId)
+		if err != nil {
+			return err
+		}
+		// the node is changed in place, so holders of it may keep it
+		node.generation = s.generation
+		node.beforeChange()
+		for i, child := range node.children {
+			node.children[i] = newId(child)
+		}
+		if moved, ok := relocated[id]; ok {
+			if s.pool != nil {
+				if err := s.forgetPage(id); err != nil {
+					return err
+				}
+			}
+			node.id = moved
+		}
+		if err := node.defragment(); err != nil {
+			return fmt.Errorf("failed to compact page [%v], error [%w]", id, err)
+		}
+		if id == rootId {
+			s.rootNode = node
+		}
+	}
+	s.freeListHead = InvalidNodeId
+	s.freeLinks = map[uint32]uint32{}
+	s.nextPageId = liveCount
+	if err := s.truncate(s.pageOffset(liveCount)); err != nil {
+		return err
+	}
+	return s.writeHeader()
+}
+
+// ids of pages reachable from the root, sorted
+func (s *tOnDiskNodeStorage) reachablePages() ([]uint32, error) {
+	live := []uint32{s.rootNode.Id()}
+	internal := []INode{}
+	if !s.rootNode.IsLeaf() {
+		internal = append(internal, s.rootNode)
+	}
+	for len(internal) > 0 {
+		node := internal[len(internal)-1]
+		internal = internal[:len(internal)-1]
+		for i := 0; i <= node.KeyCount(); i++ {
+			// a node split off keeps no child before its first key
+			if node.Child(i) == InvalidNodeId {
+				continue
+			}
+			child, err := s.LoadNode(node.Child(i))
+			if err != nil {
+				return nil, err
+			}
+			live = append(live, child.Id())
+			if !child.IsLeaf() {
+				internal = append(internal, child)
+			}
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+	for i := 1; i < len(live); i++ {
+		if live[i] == live[i-1] {
+			return nil, &TCorruptedPageError{PageId: live[i], Reason: "page is referenced twice"}
+		}
+	}
+	return live, nil
+}
+
+func (s *tOnDiskNodeStorage) isLive(live []uint32, id uint32) bool {
+	idx := sort.Search(len(live), func(i int) bool { return live[i] >= id })
+	return idx < len(live) && live[idx] == id
+}
+
+// the root is held by the storage, other nodes are loaded
+func (s *tOnDiskNodeStorage) loadForCompaction(id, rootId uint32) (*tNode, error) {
+	if id == rootId {
+		return s.rootNode.(*tNode), nil
+	}
+	node, err := s.LoadNode(id)
+	if err != nil {
+		return nil, err
+	}
+	return node.(*tNode), nil
+}
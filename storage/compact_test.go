@@ -0,0 +1,157 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+// stores keys and frees a page after every 10 of them, so free pages are spread over the file
+func makeFragmented(t *testing.T, config storage.TConfig, keys [][]byte) {
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	garbage := []uint32{}
+	for i, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+		if i%10 == 0 {
+			id, err := storage.AllocatePage(strg)
+			require.Empty(t, err)
+			garbage = append(garbage, id)
+		}
+	}
+	for _, id := range garbage {
+		require.Empty(t, strg.FreeNode(id))
+	}
+	require.Empty(t, strg.Close())
+}
+
+func checkCompact(t *testing.T, config storage.TConfig) {
+	defer removeWithLog(config.FilePath)
+	keys, _ := manyKeys(1500)
+	makeFragmented(t, config, keys)
+	before, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	reclaimed, err := strg.Compact()
+	require.Empty(t, err)
+	after, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	require.Greater(t, reclaimed, int64(0))
+	require.Equal(t, before.Size()-after.Size(), reclaimed)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	checkStored(t, tree, keys, keys)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	// the free pages were reclaimed, so a second compaction has nothing to do
+	reclaimed, err = strg.Compact()
+	require.Empty(t, err)
+	require.Equal(t, int64(0), reclaimed)
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	checkStored(t, tree, keys, keys)
+	more := make([][]byte, 300)
+	for i := range more {
+		more[i] = []byte(fmt.Sprintf("more%04d", i))
+		require.Empty(t, tree.Put(more[i], more[i]))
+	}
+	checkStored(t, tree, keys, keys)
+	checkStored(t, tree, more, more)
+}
+
+func TestCompact(t *testing.T) {
+	checkCompact(t, storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()})
+}
+
+func TestCompactBufferPool(t *testing.T) {
+	checkCompact(t, storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), BufferPoolBytes: 256 * 16})
+}
+
+func TestCompactWriteAheadLog(t *testing.T) {
+	checkCompact(t, storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), WriteAheadLog: true})
+}
+
+// a failed compaction leaves the file as it was
+func TestCompactFailure(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	keys, _ := manyKeys(500)
+	makeFragmented(t, config, keys)
+	snapshot, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	writes := 0
+	storage.SetWriteFault(strg, func(data []byte, offset int64) error {
+		writes++
+		if writes == 1 {
+			return errInjected
+		}
+		return nil
+	})
+	_, err = strg.Compact()
+	storage.SetWriteFault(strg, nil)
+	require.ErrorIs(t, err, errInjected)
+	actual, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	require.Equal(t, snapshot, actual)
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, keys)
+}
+
+// nodes loaded before a compaction can not be saved after it, the ones it changed in place can
+func TestCompactStaleNode(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	keys, _ := manyKeys(500)
+	makeFragmented(t, config, keys)
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	root := strg.RootNode()
+	child, err := strg.LoadNode(root.Child(0))
+	require.Empty(t, err)
+	_, err = strg.Compact()
+	require.Empty(t, err)
+	require.ErrorIs(t, child.Save(), storage.ErrStaleNode)
+	require.Empty(t, root.Save())
+	child, err = strg.LoadNode(strg.RootNode().Child(0))
+	require.Empty(t, err)
+	require.Empty(t, child.Save())
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, keys)
+}
+
+// a tree kept over the storage goes on after a compaction, its cached rightmost leaf is loaded again
+func TestCompactOpenTree(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	keys, _ := manyKeys(1000)
+	makeFragmented(t, config, keys[:500])
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{AppendFastPath: true})
+	for _, key := range keys[500:750] {
+		require.Empty(t, tree.Put(key, key))
+	}
+	generation := strg.Generation()
+	reclaimed, err := strg.Compact()
+	require.Empty(t, err)
+	require.Greater(t, reclaimed, int64(0))
+	require.Greater(t, strg.Generation(), generation)
+	for _, key := range keys[750:] {
+		require.Empty(t, tree.Put(key, key))
+	}
+	checkStored(t, tree, keys, keys)
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+Pages are compressed as a whole when TConfig.PageCodec is set: the page keeps its size and place in the file,
+but only its compressed image is written and the whole file system blocks past it are punched out of the file.
+A page is kept uncompressed unless its image leaves at least one whole block to punch, so a codec is rejected
+for pages smaller than two blocks. Logical pages larger than PageSizeBytes are not supported, a page holds
+as many tuples compressed as uncompressed. The image starts with flags [1] + codec [1] + compressed length [4],
+and the page it expands to is parsed and verified as any other. Pages record their codec, so a file may mix codecs.
+*/
+
+/******************* PUBLIC *******************/
+const (
+	CodecNone  byte = 0
+	CodecFlate byte = 1 // compress/flate with the default level
+)
+
+/******************* PRIVATE *******************/
+const compressedPageHeaderSizeBytes = 6
+const minCompressionSavingBytes = 4096 // a block of common file systems, assumed for devices other than files
+
+func checkCodec(config TConfig) error {
+	if config.PageCodec > CodecFlate {
+		return fmt.Errorf("unknown page codec [%v]", config.PageCodec)
+	}
+	if config.PageCodec != CodecNone && config.PageSizeBytes < 2*minCompressionSavingBytes {
+		return fmt.Errorf("page codec requires pages of [%v] bytes or more, got [%v]", 2*minCompressionSavingBytes, config.PageSizeBytes)
+	}
+	return nil
+}
+
+// files of layout versions 1 and 2 can not record the feature, so older readers would not reject compressed pages
+func (s *tOnDiskNodeStorage) enableCompression() error {
+	if s.config.PageCodec == CodecNone {
+		return nil
+	}
+	if s.layoutVersion < 3 {
+		return fmt.Errorf("%w: compression requires layout version 3 or later, the file has [%v]", ErrIncompatible, s.layoutVersion)
+	}
+	return s.enableFeatures(FeatureCompression)
+}
+
+// returns the page as it is written and the length of its image, bytes past it are not written
+func (s *tOnDiskNodeStorage) physicalPage(id uint32, logical []byte) ([]byte, uint32, error) {
+	image, err := s.compressedImage(id, logical)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.encryption != nil {
+		if image, err = s.encryptPage(id, image); err != nil {
+			return nil, 0, err
+		}
+	}
+	used := uint32(len(image))
+	if used == s.config.PageSizeBytes {
+		return image, used, nil
+	}
+	page := make([]byte, s.config.PageSizeBytes)
+	copy(page, image)
+	return page, used, nil
+}
+
+// the logical page itself unless compression frees a block
+func (s *tOnDiskNodeStorage) compressedImage(id uint32, logical []byte) ([]byte, error) {
+	if s.config.PageCodec == CodecNone {
+		return logical, nil
+	}
+	compressed, err := s.compress(logical)
+	if err != nil {
+		return nil, err
+	}
+	used := compressedPageHeaderSizeBytes + len(compressed)
+	// encryption adds its header and tag to the image
+	sealed := uint32(used) + s.config.PageSizeBytes - s.config.NodeSizeBytes()
+	if start, end := s.punchRange(id, sealed); start >= end {
+		return logical, nil
+	}
+	image := make([]byte, used)
+	image[0] = setBit(setBit(0, 0), 4)
+	image[1] = s.config.PageCodec
+	binary.BigEndian.PutUint32(image[2:], uint32(len(compressed)))
+	copy(image[compressedPageHeaderSizeBytes:], compressed)
+	return image, nil
+}
+
+/*
+Writes the whole page, so a rollback restores the whole page, then punches out the blocks past the image.
+Punching is best-effort, the punched bytes read as zeroes either way, failures are counted in the statistics.
+*/
+func (s *tOnDiskNodeStorage) writePage(id uint32, logical []byte, write func([]byte, int64) error) error {
+	page, used, err := s.physicalPage(id, logical)
+	if err != nil {
+		return err
+	}
+	if err := write(page, s.pageOffset(id)); err != nil {
+		return err
+	}
+	s.punchPage(id, used)
+	return nil
+}
+
+// punches out the whole blocks of a written page past its used bytes, other devices keep them
+func (s *tOnDiskNodeStorage) punchPage(id uint32, used uint32) {
+	file := s.osFile()
+	if used == s.config.PageSizeBytes || file == nil {
+		return
+	}
+	start, end := s.punchRange(id, used)
+	if start >= end {
+		return
+	}
+	if err := punchHole(file, start, end-start); err != nil {
+		s.stats.PunchFailures += 1
+		return
+	}
+	s.stats.CompressedPages += 1
+}
+
+// whole blocks of the page past its used bytes, the range is empty when there are none
+func (s *tOnDiskNodeStorage) punchRange(id uint32, used uint32) (int64, int64) {
+	if s.blockSize == 0 {
+		s.blockSize = minCompressionSavingBytes
+		if file := s.osFile(); file != nil {
+			if size := fileBlockSize(file); size > 0 {
+				s.blockSize = size
+			}
+		}
+	}
+	start := s.pageOffset(id) + int64(used)
+	end := s.pageOffset(id) + int64(s.config.PageSizeBytes)
+	return (start + s.blockSize - 1) / s.blockSize * s.blockSize, end / s.blockSize * s.blockSize
+}
+
+func (s *tOnDiskNodeStorage) compress(logical []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	if s.compressor == nil {
+		writer, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		s.compressor = writer
+	} else {
+		s.compressor.Reset(&compressed)
+	}
+	if _, err := s.compressor.Write(logical); err != nil {
+		return nil, err
+	}
+	if err := s.compressor.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// parses a page read from the file, which may be encrypted and compressed
+func (s *tOnDiskNodeStorage) decodePage(id uint32, raw []byte) (*tNode, error) {
+	decoded := false
+	var err error
+	if s.encryption != nil {
+		if raw, err = s.decryptPage(id, raw); err != nil {
+			return nil, err
+		}
+		decoded = true
+	}
+	if checkBit(raw[0], 4) {
+		if raw, err = s.decompress(id, raw); err != nil {
+			return nil, err
+		}
+		decoded = true
+	}
+	node, err := s.makeNodeFromRaw(id, raw)
+	if err != nil {
+		return nil, err
+	}
+	node.decoded = decoded
+	return node, nil
+}
+
+func (s *tOnDiskNodeStorage) decompress(id uint32, raw []byte) ([]byte, error) {
+	corrupted := func(format string, args ...any) ([]byte, error) {
+		return nil, &TCorruptedPageError{PageId: id, Reason: fmt.Sprintf(format, args...)}
+	}
+	if raw[1] != CodecFlate {
+		return corrupted("unknown codec [%v]", raw[1])
+	}
+	length := uint64(binary.BigEndian.Uint32(raw[2:]))
+	if compressedPageHeaderSizeBytes+length > uint64(len(raw)) {
+		return corrupted("compressed image of [%v] bytes does not fit into the page", length)
+	}
+	source := bytes.NewReader(raw[compressedPageHeaderSizeBytes : compressedPageHeaderSizeBytes+length])
+	if s.decompressor == nil {
+		s.decompressor = flate.NewReader(source)
+	} else if err := s.decompressor.(flate.Resetter).Reset(source, nil); err != nil {
+		return nil, err
+	}
+	logical := make([]byte, s.config.NodeSizeBytes())
+	if _, err := io.ReadFull(s.decompressor, logical); err != nil {
+		return corrupted("failed to decompress, error [%v]", err)
+	}
+	if n, err := s.decompressor.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return corrupted("compressed image expands past the page")
+	}
+	return logical, nil
+}
@@ -0,0 +1,135 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+func jsonValues(keys [][]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = []byte(fmt.Sprintf(`{"key": "%s", "status": "active", "tags": ["alpha", "beta", "gamma"], "count": %v}`, key, i))
+	}
+	return values
+}
+
+// a file written with a codec stays readable without it, and pages written without it are readable with it
+func TestPageCompression(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 16 * 1024, FilePath: "./" + fileName(), PageCodec: storage.CodecFlate}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(3000)
+	values := jsonValues(keys)
+	for i := range keys[:2000] {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	require.Greater(t, strg.Statistics().CompressedPages, uint64(0))
+	checkStored(t, tree, keys[:2000], values[:2000])
+	require.Equal(t, storage.FeatureCompression, strg.Config().Features&storage.FeatureCompression)
+	punchFailures := strg.Statistics().PunchFailures
+	require.Empty(t, strg.Close())
+
+	// on file systems with hole punching every compressed leaf frees most of its blocks
+	info, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	if allocated, ok := allocatedBytes(info); ok && punchFailures == 0 {
+		require.Greater(t, info.Size()-allocated, int64(10*8*1024))
+	}
+
+	uncompressed := config
+	uncompressed.PageCodec = storage.CodecNone
+	strg, err = storage.MakeNodeStorage(uncompressed)
+	require.Empty(t, err)
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	checkStored(t, tree, keys[:2000], values[:2000])
+	for i := 2000; i < len(keys); i++ {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	require.Equal(t, uint64(0), strg.Statistics().CompressedPages)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, values)
+}
+
+func TestCorruptedCompressedPage(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 16 * 1024, FilePath: "./" + fileName(), PageCodec: storage.CodecFlate}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	rootId := strg.RootNode().Id()
+	require.Empty(t, strg.Close())
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	page := data[64+int(rootId*config.PageSizeBytes):]
+	require.Equal(t, storage.CodecFlate, page[1])
+	page[6+binary.BigEndian.Uint32(page[2:])/2] ^= 0xff
+	require.Empty(t, os.WriteFile(config.FilePath, data, 0644))
+
+	_, err = storage.MakeNodeStorage(config)
+	var corrupted *storage.TCorruptedPageError
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, rootId, corrupted.PageId)
+}
+
+func TestCrashRecoveryCompressed(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 16 * 1024, FilePath: "./" + fileName(), BufferPoolBytes: 16 * 1024 * 8, WriteAheadLog: true, PageCodec: storage.CodecFlate}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	})
+}
+
+func TestPutFailureAtomicCompressed(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 8 * 1024, FilePath: "./" + fileName(), MaxCellsCount: 5, PageCodec: storage.CodecFlate}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTree(strg, 5)
+	})
+}
+
+// compression frees no block of pages smaller than two of them
+func TestCodecPageSize(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 4 * 1024, FilePath: "./" + fileName(), PageCodec: storage.CodecFlate}
+	defer os.Remove(config.FilePath)
+	_, err := storage.MakeNodeStorage(config)
+	require.Error(t, err)
+	_, err = os.Stat(config.FilePath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	config.PageCodec = 7
+	config.PageSizeBytes = 8 * 1024
+	_, err = storage.MakeNodeStorage(config)
+	require.Error(t, err)
+}
+
+// holes are aligned to blocks, so only pages which freed a whole block are counted
+func TestPageCompressionBlocks(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 8 * 1024, FilePath: "./" + fileName(), PageCodec: storage.CodecFlate}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(1000)
+	values := jsonValues(keys)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	stats := *strg.Statistics()
+	require.Empty(t, strg.Close())
+	info, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	allocated, ok := allocatedBytes(info)
+	if !ok || stats.PunchFailures > 0 {
+		t.Skip("the file system does not punch holes")
+	}
+	require.Greater(t, stats.CompressedPages, uint64(0))
+	require.GreaterOrEqual(t, info.Size()-allocated, int64(4096))
+}
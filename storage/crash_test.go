@@ -0,0 +1,299 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+/*
+Crash simulation: the storage runs on devices recording every write and truncation of the data file
+and of the log, in the order they were issued. A crash is a prefix of the recorded changes replayed
+into fresh files, optionally with the last write torn into some of its sectors or cut short.
+Writes are assumed to reach the medium in order, as with a device syncing after every write.
+With the write-ahead log a crash may also lose the log changes made after its last sync while
+keeping every write to the data file, as the OS writes the two files back on its own.
+
+Every replay is opened with MakeNodeStorage and must hold a well formed tree with every put
+acknowledged before the crash, the put in progress may be there or not. If the log changes were
+lost, only puts acknowledged before the last sync of the log are required.
+*/
+
+const (
+	tornNone    = iota
+	tornSectors // only some sectors of the last write reached the medium
+	tornPartial // the last write stopped after some bytes
+)
+
+const sectorSizeBytes = 512
+
+type tRecordedWrite struct {
+	log      bool
+	truncate bool
+	sync     bool
+	offset   int64 // size of truncations
+	data     []byte
+}
+
+type tRecorder struct {
+	mutex  sync.Mutex
+	writes []tRecordedWrite
+}
+
+type tRecordingDevice struct {
+	storage.IBlockDevice
+	recorder *tRecorder
+	log      bool
+}
+
+func (d *tRecordingDevice) WriteAt(data []byte, offset int64) (int, error) {
+	d.recorder.mutex.Lock()
+	defer d.recorder.mutex.Unlock()
+	d.recorder.writes = append(d.recorder.writes, tRecordedWrite{log: d.log, offset: offset, data: append([]byte{}, data...)})
+	return d.IBlockDevice.WriteAt(data, offset)
+}
+
+func (d *tRecordingDevice) Truncate(size int64) error {
+	d.recorder.mutex.Lock()
+	defer d.recorder.mutex.Unlock()
+	d.recorder.writes = append(d.recorder.writes, tRecordedWrite{log: d.log, truncate: true, offset: size})
+	return d.IBlockDevice.Truncate(size)
+}
+
+func (d *tRecordingDevice) Sync() error {
+	d.recorder.mutex.Lock()
+	defer d.recorder.mutex.Unlock()
+	d.recorder.writes = append(d.recorder.writes, tRecordedWrite{log: d.log, sync: true})
+	return d.IBlockDevice.Sync()
+}
+
+func (r *tRecorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.writes)
+}
+
+// count of the writes up to the last sync of the log among the first count writes
+func (r *tRecorder) logSynced(count int) int {
+	for i := count - 1; i >= 0; i-- {
+		if r.writes[i].log && r.writes[i].sync {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+/*
+Applies the first count writes to empty images of the data file and the log and stores them at filePath.
+With lostLog the log changes after its last sync are skipped.
+*/
+func (r *tRecorder) replay(t *testing.T, rnd *rand.Rand, filePath string, count int, torn int, lostLog bool) {
+	images := [2][]byte{}
+	synced := r.logSynced(count)
+	for i, write := range r.writes[:count] {
+		image := &images[0]
+		if write.log {
+			image = &images[1]
+		}
+		if write.sync || (lostLog && write.log && i >= synced) {
+			continue
+		}
+		if write.truncate {
+			*image = resizeImage(*image, write.offset)
+			continue
+		}
+		if end := write.offset + int64(len(write.data)); end > int64(len(*image)) {
+			*image = resizeImage(*image, end)
+		}
+		if i < count-1 || torn == tornNone {
+			copy((*image)[write.offset:], write.data)
+			continue
+		}
+		if torn == tornPartial {
+			copy((*image)[write.offset:], write.data[:rnd.Intn(len(write.data)+1)])
+			continue
+		}
+		// sectors are aligned to the offsets on the medium
+		for start := int64(0); start < int64(len(write.data)); {
+			end := (write.offset + start + sectorSizeBytes) / sectorSizeBytes * sectorSizeBytes
+			if end-write.offset > int64(len(write.data)) {
+				end = write.offset + int64(len(write.data))
+			}
+			if rnd.Intn(2) == 0 {
+				copy((*image)[write.offset+start:], write.data[start:end-write.offset])
+			}
+			start = end - write.offset
+		}
+	}
+	require.Empty(t, os.WriteFile(filePath, images[0], 0644))
+	require.Empty(t, os.WriteFile(filePath+".wal", images[1], 0644))
+}
+
+// the gap of a growing image reads as zeroes
+func resizeImage(image []byte, size int64) []byte {
+	if size <= int64(len(image)) {
+		return image[:size]
+	}
+	return append(image, make([]byte, size-int64(len(image)))...)
+}
+
+/*
+Walks the tree from the root: every page is reachable once, keys of a node are ordered and lie
+between the separators of the parent, leaves are on the same depth. Returns keys and values of the leaves.
+*/
+func checkIntegrity(t *testing.T, strg storage.INodeStorage) ([][]byte, [][]byte) {
+	keys, values := [][]byte{}, [][]byte{}
+	visited := map[uint32]bool{}
+	leafDepth := -1
+	var walk func(node storage.INode, lower, upper []byte, depth int)
+	walk = func(node storage.INode, lower, upper []byte, depth int) {
+		require.False(t, visited[node.Id()], "page [%v] is referenced twice", node.Id())
+		visited[node.Id()] = true
+		var previous []byte
+		for i := 0; i < node.KeyCount(); i++ {
+			key, err := node.KeyFull(i)
+			require.Empty(t, err)
+			require.True(t, previous == nil || bytes.Compare(previous, key) == -1, "keys of page [%v] are not ordered", node.Id())
+			require.True(t, lower == nil || bytes.Compare(lower, key) != 1, "key [%s] of page [%v] is below its range", key, node.Id())
+			require.True(t, upper == nil || bytes.Compare(key, upper) == -1, "key [%s] of page [%v] is above its range", key, node.Id())
+			previous = key
+			if node.IsLeaf() {
+				keys = append(keys, key)
+				values = append(values, append([]byte{}, node.Value(i)...))
+			}
+		}
+		if node.IsLeaf() {
+			if leafDepth == -1 {
+				leafDepth = depth
+			}
+			require.Equal(t, leafDepth, depth, "leaf [%v] is on another depth", node.Id())
+			return
+		}
+		// child i holds keys less than key i
+		for i := 0; i <= node.KeyCount(); i++ {
+			if node.Child(i) == storage.InvalidNodeId {
+				continue
+			}
+			childLower, childUpper := lower, upper
+			if i > 0 {
+				childLower, _ = node.KeyFull(i - 1)
+			}
+			if i < node.KeyCount() {
+				childUpper, _ = node.KeyFull(i)
+			}
+			child, err := strg.LoadNode(node.Child(i))
+			require.Empty(t, err, "child [%v] of page [%v]", node.Child(i), node.Id())
+			walk(child, childLower, childUpper, depth+1)
+		}
+	}
+	walk(strg.RootNode(), nil, nil, 0)
+	return keys, values
+}
+
+/*
+Puts keys on recording devices, then replays random prefixes of the recorded writes. Every replay
+is opened, checked for integrity, for the acknowledged puts and for accepting another put.
+*/
+func checkCrashSimulation(t *testing.T, config storage.TConfig, replays int) {
+	seed := int64(1)
+	rnd := rand.New(rand.NewSource(seed))
+	recorder := &tRecorder{}
+	recording := config
+	recording.Device = &tRecordingDevice{IBlockDevice: storage.MakeMemoryDevice(), recorder: recorder}
+	if config.WriteAheadLog {
+		recording.LogDevice = &tRecordingDevice{IBlockDevice: storage.MakeMemoryDevice(), recorder: recorder, log: true}
+	}
+	strg, err := storage.MakeNodeStorage(recording)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(150)
+	rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	values := jsonValues(keys)
+	// acknowledged[i] is the count of writes recorded when put i returned
+	created := recorder.count()
+	acknowledged := make([]int, len(keys))
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+		acknowledged[i] = recorder.count()
+	}
+	require.Empty(t, strg.Close())
+	total := recorder.count()
+	require.Greater(t, total, created)
+
+	dir := t.TempDir()
+	expected := map[string][]byte{}
+	for i := range keys {
+		expected[string(keys[i])] = values[i]
+	}
+	for replay := 0; replay < replays; replay++ {
+		count := created + rnd.Intn(total-created+1)
+		torn := rnd.Intn(3)
+		last := recorder.writes[count-1]
+		lostLog := config.WriteAheadLog && replay%4 == 3
+		if count == created || last.truncate || last.sync || lostLog {
+			torn = tornNone
+		}
+		crash := fmt.Sprintf("crash of seed [%v] after write [%v] of [%v], torn [%v], lost log [%v]", seed, count, total, torn, lostLog)
+
+		replayed := config
+		replayed.FilePath = filepath.Join(dir, fmt.Sprintf("replay%v", replay))
+		recorder.replay(t, rnd, replayed.FilePath, count, torn, lostLog)
+		strg, err := storage.MakeNodeStorage(replayed)
+		require.Empty(t, err, crash)
+		stored, storedValues := checkIntegrity(t, strg)
+		found := map[string]bool{}
+		for i, key := range stored {
+			value, ok := expected[string(key)]
+			require.True(t, ok, "unknown key [%s], %v", key, crash)
+			require.Equal(t, value, storedValues[i], crash)
+			found[string(key)] = true
+		}
+		// a torn write was in progress, so the put it belongs to was not acknowledged
+		complete := count
+		if torn != tornNone {
+			complete--
+		}
+		if lostLog {
+			complete = recorder.logSynced(count)
+		}
+		for i := range keys {
+			if acknowledged[i] > complete {
+				break
+			}
+			require.True(t, found[string(keys[i])], "acknowledged key [%s] is lost, %v", keys[i], crash)
+		}
+		tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+		require.Empty(t, tree.Put([]byte("after crash"), []byte("value")), crash)
+		checkStored(t, tree, [][]byte{[]byte("after crash")}, [][]byte{[]byte("value")})
+		// pages taken by the put were free, so the keys stored before are intact
+		after, _ := checkIntegrity(t, strg)
+		require.Equal(t, len(stored)+1, len(after), crash)
+		require.Empty(t, strg.Close())
+		removeWithLog(replayed.FilePath)
+	}
+}
+
+func TestCrashSimulationWriteAheadLog(t *testing.T) {
+	checkCrashSimulation(t, storage.TConfig{PageSizeBytes: 1024, WriteAheadLog: true}, 300)
+}
+
+func TestCrashSimulationWriteAheadLogBufferPool(t *testing.T) {
+	checkCrashSimulation(t, storage.TConfig{PageSizeBytes: 1024, BufferPoolBytes: 1024 * 8, WriteAheadLog: true, CheckpointBytes: 16 * 1024}, 300)
+}
+
+func TestCrashSimulationCopyOnWrite(t *testing.T) {
+	checkCrashSimulation(t, storage.TConfig{PageSizeBytes: 1024, CopyOnWrite: true}, 300)
+}
+
+func TestCrashSimulationEncrypted(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, BufferPoolBytes: 1024 * 8, WriteAheadLog: true, KeyProvider: testKeyProvider(t, testKey)}
+	checkCrashSimulation(t, config, 100)
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+/*
+The storage keeps its pages and its write-ahead log on block devices. By default they are the file at
+TConfig.FilePath and the log next to it, TConfig.Device and TConfig.LogDevice replace them, for example
+with a device in memory, one injecting faults or one spreading pages over several files.
+*/
+
+/******************* PUBLIC *******************/
+/*
+Byte addressed medium of the pages: pages are written whole or in parts and read whole, the header takes
+the first bytes. Reads of snapshots and syncs of durability policies come from other goroutines,
+so a device has to be safe for concurrent use. The storage closes the devices it was given.
+*/
+type IBlockDevice interface {
+	// reads len(data) bytes at offset, fewer bytes are only read at the end of the device, with io.EOF
+	ReadAt(data []byte, offset int64) (int, error)
+	// writes past the end extend the device, the gap reads as zeroes
+	WriteAt(data []byte, offset int64) (int, error)
+	// returns once the written bytes are durable
+	Sync() error
+	Size() (int64, error)
+	Truncate(size int64) error
+	Close() error
+}
+
+// keeps the bytes in memory, they outlive Close, so a storage can be opened on the device again
+func MakeMemoryDevice() IBlockDevice {
+	return &tMemoryDevice{}
+}
+
+func (d *tMemoryDevice) ReadAt(data []byte, offset int64) (int, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	read := copy(data, d.data[offset:])
+	if read < len(data) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (d *tMemoryDevice) WriteAt(data []byte, offset int64) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if end := offset + int64(len(data)); end > int64(len(d.data)) {
+		d.resize(end)
+	}
+	return copy(d.data[offset:], data), nil
+}
+
+func (d *tMemoryDevice) Sync() error {
+	return nil
+}
+
+func (d *tMemoryDevice) Size() (int64, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return int64(len(d.data)), nil
+}
+
+func (d *tMemoryDevice) Truncate(size int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	d.resize(size)
+	return nil
+}
+
+func (d *tMemoryDevice) Close() error {
+	return nil
+}
+
+/******************* PRIVATE *******************/
+func (d *tMemoryDevice) resize(size int64) {
+	if size <= int64(cap(d.data)) {
+		// bytes past the old length may be left from a truncation
+		old := int64(len(d.data))
+		d.data = d.data[:size]
+		for i := old; i < size; i++ {
+			d.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, 2*size)
+	copy(data, d.data)
+	d.data = data
+}
+
+func (d *tFileDevice) ReadAt(data []byte, offset int64) (int, error) {
+	return d.file.ReadAt(data, offset)
+}
+
+func (d *tFileDevice) WriteAt(data []byte, offset int64) (int, error) {
+	return d.file.WriteAt(data, offset)
+}
+
+func (d *tFileDevice) Sync() error {
+	return d.file.Sync()
+}
+
+func (d *tFileDevice) Size() (int64, error) {
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d *tFileDevice) Truncate(size int64) error {
+	return d.file.Truncate(size)
+}
+
+func (d *tFileDevice) Close() error {
+	return d.file.Close()
+}
+
+func checkDevices(config TConfig) error {
+	if config.Device == nil {
+		if config.LogDevice != nil {
+			return errors.New("log device is only used along with a device")
+		}
+		return nil
+	}
+	if config.MemoryMapped {
+		return errors.New("memory mapping requires a file")
+	}
+	if config.WriteAheadLog && config.LogDevice == nil {
+		return errors.New("write-ahead log on a device requires a log device")
+	}
+	return nil
+}
+
+// a device holding no bytes is a new storage
+func storageExists(config TConfig) (bool, error) {
+	if config.Device == nil {
+		return fileExists(config.FilePath)
+	}
+	size, err := config.Device.Size()
+	if err != nil {
+		return false, err
+	}
+	return size > 0, nil
+}
+
+func createDevice(config TConfig) (IBlockDevice, error) {
+	if config.Device != nil {
+		return config.Device, nil
+	}
+	file, err := os.Create(config.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &tFileDevice{file: file}, nil
+}
+
+func openDevice(config TConfig) (IBlockDevice, error) {
+	if config.Device != nil {
+		return config.Device, nil
+	}
+	file, err := os.OpenFile(config.FilePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &tFileDevice{file: file}, nil
+}
+
+// only set for file devices, which are mapped and punched
+func (s *tOnDiskNodeStorage) osFile() *os.File {
+	if device, ok := s.device.(*tFileDevice); ok {
+		return device.file
+	}
+	return nil
+}
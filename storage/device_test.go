@@ -0,0 +1,111 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+// fails a single write once the given number of writes succeeded, a negative number disables the fault
+type tFaultyDevice struct {
+	storage.IBlockDevice
+	writesLeft int
+}
+
+func (d *tFaultyDevice) WriteAt(data []byte, offset int64) (int, error) {
+	if d.writesLeft == 0 {
+		d.writesLeft = -1
+		return 0, errInjected
+	}
+	d.writesLeft--
+	return d.IBlockDevice.WriteAt(data, offset)
+}
+
+func checkMemoryDevice(t *testing.T, config storage.TConfig) {
+	config.Device = storage.MakeMemoryDevice()
+	if config.WriteAheadLog {
+		config.LogDevice = storage.MakeMemoryDevice()
+	}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(1000)
+	values := jsonValues(keys)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	require.Empty(t, strg.Close())
+	_, err = os.Stat(config.FilePath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, values)
+}
+
+func TestMemoryDevice(t *testing.T) {
+	checkMemoryDevice(t, storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName()})
+}
+
+func TestMemoryDeviceWriteAheadLog(t *testing.T) {
+	checkMemoryDevice(t, storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), BufferPoolBytes: 512 * 8, WriteAheadLog: true})
+}
+
+func TestMemoryDeviceCopyOnWrite(t *testing.T) {
+	checkMemoryDevice(t, storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), CopyOnWrite: true})
+}
+
+// a put failed by the device is rolled back, the committed puts survive a reopen
+func TestFaultyDevice(t *testing.T) {
+	device := &tFaultyDevice{IBlockDevice: storage.MakeMemoryDevice(), writesLeft: -1}
+	config := storage.TConfig{PageSizeBytes: 512, Device: device}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTree(strg, 0)
+	keys, _ := manyKeys(300)
+	failed := 0
+	for i, key := range keys {
+		device.writesLeft = -1
+		if i%7 == 6 {
+			device.writesLeft = i % 3
+		}
+		if err := tree.Put(key, key); err != nil {
+			require.ErrorIs(t, err, errInjected)
+			keys[i] = nil
+			failed++
+		}
+	}
+	device.writesLeft = -1
+	require.Greater(t, failed, 0)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree = btree.MakePagedBTree(strg, 0)
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		value, err := tree.Get(key)
+		require.Empty(t, err)
+		require.Equal(t, key, value)
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	invalid := []storage.TConfig{
+		{PageSizeBytes: 512, Device: storage.MakeMemoryDevice(), MemoryMapped: true},
+		{PageSizeBytes: 512, Device: storage.MakeMemoryDevice(), WriteAheadLog: true},
+		{PageSizeBytes: 512, FilePath: "./" + fileName(), LogDevice: storage.MakeMemoryDevice()},
+	}
+	for _, config := range invalid {
+		_, err := storage.MakeNodeStorage(config)
+		require.NotEmpty(t, err)
+	}
+	require.NotEmpty(t, storage.Migrate(storage.TConfig{Device: storage.MakeMemoryDevice()}))
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Durability policies decide when committed operations are synced. The write-ahead log is synced when
+it is enabled, as it holds every committed operation, otherwise the data file is. Copy-on-write syncs
+every commit to order the pages before the meta page, which meets every policy.
+*/
+
+/******************* PUBLIC *******************/
+const (
+	DurabilityNone        TDurability = iota // syncs are left to the OS, a crash may lose committed operations
+	DurabilitySync                           // every operation is synced before its commit returns
+	DurabilityTimer                          // a crash loses at most the operations of the last SyncInterval
+	DurabilityGroupCommit                    // WaitDurable shares a sync between operations committed concurrently, requires the buffer pool
+)
+
+const defaultSyncInterval = time.Second
+
+var durabilityNames = []string{"none", "sync", "timer", "group"}
+
+func (d TDurability) String() string {
+	if int(d) < len(durabilityNames) {
+		return durabilityNames[d]
+	}
+	return fmt.Sprintf("unknown durability [%v]", uint8(d))
+}
+
+// takes one of "none", "sync", "timer" and "group"
+func ParseDurability(name string) (TDurability, error) {
+	for i, known := range durabilityNames {
+		if name == known {
+			return TDurability(i), nil
+		}
+	}
+	return DurabilityNone, fmt.Errorf("unknown durability [%v]", name)
+}
+
+/*
+Blocks until the operations committed so far are synced. With DurabilityGroupCommit one of the waiting
+callers syncs for all of them while the others wait, so callers should not hold locks which keep other
+operations from committing. With other policies it returns immediately.
+An error means that committed operations may be lost by a crash.
+*/
+func (s *tOnDiskNodeStorage) WaitDurable() error {
+	d := s.durability
+	if d == nil || d.policy != DurabilityGroupCommit {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	target := d.committed
+	for d.synced < target {
+		if d.syncing {
+			d.cond.Wait()
+			continue
+		}
+		if err := d.syncLocked(s.stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/******************* PRIVATE *******************/
+func checkDurability(config TConfig) error {
+	if config.Durability > DurabilityGroupCommit {
+		return fmt.Errorf("unknown durability [%v]", uint8(config.Durability))
+	}
+	if config.Durability != DurabilityNone && config.BufferPoolBytes != 0 && !config.WriteAheadLog {
+		return errors.New("durability with the buffer pool requires the write-ahead log, committed pages are kept in memory")
+	}
+	// without the buffer pool every commit writes its pages in place, which syncs the log first and leaves nothing to share,
+	// copy-on-write syncs every commit anyway
+	if config.Durability == DurabilityGroupCommit && config.BufferPoolBytes == 0 && !config.CopyOnWrite {
+		return errors.New("group commit requires the buffer pool and the write-ahead log")
+	}
+	return nil
+}
+
+// the timer of DurabilityTimer is started as well, it is stopped on close
+func (s *tOnDiskNodeStorage) startDurability() {
+	if s.config.Durability == DurabilityNone || s.shadow != nil {
+		return
+	}
+	d := &tDurability{policy: s.config.Durability, target: s.device}
+	if s.wal != nil {
+		d.target = s.wal.device
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	s.durability = d
+	if d.policy != DurabilityTimer {
+		return
+	}
+	interval := s.config.SyncInterval
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	d.stop = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mutex.Lock()
+				if d.synced < d.committed && !d.syncing {
+					// a failure is reported by the next commit
+					d.err = d.syncLocked(s.stats)
+				}
+				d.mutex.Unlock()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// called by Commit while the operation is still in progress, so a failed sync rolls it back
+func (s *tOnDiskNodeStorage) syncCommit() error {
+	d := s.durability
+	switch d.policy {
+	case DurabilitySync:
+		return syncDevice(d.target, s.stats)
+	case DurabilityTimer:
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.err != nil {
+			err := d.err
+			d.err = nil
+			return fmt.Errorf("background sync failed with error [%w]", err)
+		}
+	}
+	return nil
+}
+
+// counts the operation once it is committed
+func (d *tDurability) committedOne() {
+	d.mutex.Lock()
+	d.committed += 1
+	d.mutex.Unlock()
+}
+
+// syncs without holding the mutex, the operations committed meanwhile are left to the next sync
+func (d *tDurability) syncLocked(stats *TStorageStatistics) error {
+	d.syncing = true
+	upTo := d.committed
+	d.mutex.Unlock()
+	err := syncDevice(d.target, stats)
+	d.mutex.Lock()
+	d.syncing = false
+	d.cond.Broadcast()
+	if err != nil {
+		return err
+	}
+	d.synced = upTo
+	return nil
+}
+
+// stops the timer, committed operations are synced by Close
+func (d *tDurability) close() {
+	if d.stop != nil {
+		close(d.stop)
+		<-d.stopped
+	}
+}
+
+// syncs of group commit and of the timer are made outside of operations, so they are counted atomically
+func syncDevice(device IBlockDevice, stats *TStorageStatistics) error {
+	if err := device.Sync(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&stats.SyncCalls, 1)
+	return nil
+}
@@ -0,0 +1,138 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+func syncCalls(strg storage.INodeStorage) uint64 {
+	return atomic.LoadUint64(&strg.Statistics().SyncCalls)
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, durability := range []storage.TDurability{storage.DurabilityNone, storage.DurabilitySync, storage.DurabilityTimer, storage.DurabilityGroupCommit} {
+		parsed, err := storage.ParseDurability(durability.String())
+		require.Empty(t, err)
+		require.Equal(t, durability, parsed)
+	}
+	_, err := storage.ParseDurability("always")
+	require.Error(t, err)
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), BufferPoolBytes: 256 * 8, Durability: storage.DurabilitySync}
+	defer removeWithLog(config.FilePath)
+	_, err = storage.MakeNodeStorage(config)
+	require.Error(t, err)
+	config.WriteAheadLog = true
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Empty(t, strg.Close())
+}
+
+func TestDurabilitySync(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), WriteAheadLog: wal, Durability: storage.DurabilitySync}
+		defer removeWithLog(config.FilePath)
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+		keys, _ := manyKeys(50)
+		for _, key := range keys {
+			before := syncCalls(strg)
+			require.Empty(t, tree.Put(key, key))
+			if !wal {
+				require.Equal(t, before+1, syncCalls(strg))
+				continue
+			}
+			// the log is synced before the pages are written and again after the commit record
+			require.Equal(t, before+2, syncCalls(strg))
+		}
+		require.Empty(t, strg.Close())
+	}
+}
+
+func TestDurabilityTimer(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), Durability: storage.DurabilityTimer, SyncInterval: time.Millisecond}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	require.Empty(t, tree.Put([]byte("key"), []byte("value")))
+	require.Eventually(t, func() bool { return syncCalls(strg) > 0 }, time.Second, time.Millisecond)
+	// nothing was committed since the last sync
+	synced := syncCalls(strg)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, synced, syncCalls(strg))
+	require.Empty(t, strg.Close())
+}
+
+// syncs take long enough for concurrent writers to commit while one of them is in progress
+type tSlowSyncDevice struct {
+	storage.IBlockDevice
+}
+
+func (d *tSlowSyncDevice) Sync() error {
+	time.Sleep(time.Millisecond)
+	return d.IBlockDevice.Sync()
+}
+
+// operations committed before a wait share its sync, pages stay in the buffer pool until a checkpoint
+func TestDurabilityGroupCommit(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), WriteAheadLog: true, Durability: storage.DurabilityGroupCommit}
+	// without the buffer pool every commit syncs the log before writing its pages
+	_, err := storage.MakeNodeStorage(config)
+	require.Error(t, err)
+	config.WriteAheadLog = false
+	_, err = storage.MakeNodeStorage(config)
+	require.Error(t, err)
+
+	config.BufferPoolBytes = 256 * 1024
+	config.WriteAheadLog = true
+	config.Device = &tSlowSyncDevice{IBlockDevice: storage.MakeMemoryDevice()}
+	config.LogDevice = &tSlowSyncDevice{IBlockDevice: storage.MakeMemoryDevice()}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	for i := 0; i < 3; i++ {
+		require.Empty(t, strg.Begin())
+		require.Empty(t, strg.RootNode().Save())
+		require.Empty(t, strg.Commit())
+	}
+	require.Equal(t, uint64(0), syncCalls(strg))
+	require.Empty(t, strg.WaitDurable())
+	require.Equal(t, uint64(1), syncCalls(strg))
+	require.Empty(t, strg.WaitDurable())
+	require.Equal(t, uint64(1), syncCalls(strg))
+
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	before := syncCalls(strg)
+	clients, puts := 8, 50
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				key := []byte(fmt.Sprintf("key%v-%03d", c, i))
+				require.Empty(t, tree.Put(key, key))
+			}
+		}(c)
+	}
+	wg.Wait()
+	// puts committed while a sync is in progress share the next one, a sync per put would fail this
+	require.Less(t, syncCalls(strg)-before, uint64(clients*puts/2))
+	for c := 0; c < clients; c++ {
+		for i := 0; i < puts; i++ {
+			key := []byte(fmt.Sprintf("key%v-%03d", c, i))
+			value, err := tree.Get(key)
+			require.Empty(t, err)
+			require.Equal(t, key, value)
+		}
+	}
+}
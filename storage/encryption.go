@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Pages are encrypted with AES-GCM when TConfig.KeyProvider is set at creation, the file records the feature
+and can only be opened with the key. An encrypted page is flags [1] + write counter [8] + sealed length [4]
++ sealed image, where the image is the page as it would be written without encryption, so pages are
+compressed before they are encrypted. The nonce is the page id [4] + the write counter [8], which makes a page
+unreadable at another id. Counters grow with every page written and are reserved in batches by a header field,
+which is synced before a batch is used and is never rolled back, so a nonce is not reused after a crash.
+Free pages and meta pages of copy-on-write are not encrypted, they hold no keys or values.
+The header holds the first 8 bytes of the zero block encrypted with the key, so a wrong key fails the open.
+*/
+
+/******************* PUBLIC *******************/
+// supplies the key of an encrypted file, keys of 16, 24 or 32 bytes select AES-128, AES-192 or AES-256
+type IKeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// the file holds the key hex encoded, surrounding whitespace is ignored
+func MakeFileKeyProvider(path string) IKeyProvider {
+	return &tFileKeyProvider{path: path}
+}
+
+// the environment variable holds the key hex encoded
+func MakeEnvKeyProvider(name string) IKeyProvider {
+	return &tEnvKeyProvider{name: name}
+}
+
+func (p *tFileKeyProvider) Key() ([]byte, error) {
+	encoded, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file [%v], error [%w]", p.path, err)
+	}
+	return decodeKey(string(encoded))
+}
+
+func (p *tEnvKeyProvider) Key() ([]byte, error) {
+	encoded, ok := os.LookupEnv(p.name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable [%v] is not set", p.name)
+	}
+	return decodeKey(encoded)
+}
+
+/******************* PRIVATE *******************/
+const encryptedPageHeaderSizeBytes = 13 // flags [1] + write counter [8] + sealed length [4]
+const gcmTagSizeBytes = 16
+const keyCheckOffset = 40
+const keyCheckSizeBytes = 8
+const reservedCountersOffset = 48
+const countersBatch = 1 << 16
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key, error [%w]", err)
+	}
+	return key, nil
+}
+
+// nil without a provider
+func makeEncryption(provider IKeyProvider) (*tEncryption, error) {
+	if provider == nil {
+		return nil, nil
+	}
+	key, err := provider.Key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, 12)
+	if err != nil {
+		return nil, err
+	}
+	checkValue := make([]byte, aes.BlockSize)
+	block.Encrypt(checkValue, checkValue)
+	return &tEncryption{aead: aead, checkValue: checkValue[:keyCheckSizeBytes], counter: 1, reserved: 1}, nil
+}
+
+// checks the key against the header, writes continue past the counters reserved by the previous runs
+func (s *tOnDiskNodeStorage) openEncryption(header []byte) error {
+	if s.config.Features&FeatureEncryption == 0 {
+		if s.config.KeyProvider != nil {
+			return fmt.Errorf("%w: file [%v] is not encrypted", ErrIncompatible, s.config.FilePath)
+		}
+		return nil
+	}
+	if s.config.KeyProvider == nil {
+		return fmt.Errorf("%w: file [%v] is encrypted, a key provider is required", ErrIncompatible, s.config.FilePath)
+	}
+	encryption, err := makeEncryption(s.config.KeyProvider)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encryption.checkValue, header[keyCheckOffset:keyCheckOffset+keyCheckSizeBytes]) {
+		return fmt.Errorf("%w: file [%v]", ErrWrongKey, s.config.FilePath)
+	}
+	if reserved := binary.BigEndian.Uint64(header[reservedCountersOffset:]); reserved > encryption.reserved {
+		encryption.counter, encryption.reserved = reserved, reserved
+	}
+	s.encryption = encryption
+	return nil
+}
+
+// the reservation is written past the bytes of writeHeader, so rollbacks and the write-ahead log never restore it
+func (s *tOnDiskNodeStorage) nextCounter() (uint64, error) {
+	e := s.encryption
+	if e.counter == e.reserved {
+		reserved := e.reserved + countersBatch
+		if err := s.write(binary.BigEndian.AppendUint64(nil, reserved), reservedCountersOffset); err != nil {
+			return 0, err
+		}
+		if err := syncDevice(s.device, s.stats); err != nil {
+			return 0, err
+		}
+		e.reserved = reserved
+	}
+	e.counter++
+	return e.counter - 1, nil
+}
+
+func (s *tOnDiskNodeStorage) encryptPage(id uint32, image []byte) ([]byte, error) {
+	counter, err := s.nextCounter()
+	if err != nil {
+		return nil, err
+	}
+	nonce := binary.BigEndian.AppendUint32(nil, id)
+	nonce = binary.BigEndian.AppendUint64(nonce, counter)
+	page := make([]byte, encryptedPageHeaderSizeBytes, encryptedPageHeaderSizeBytes+len(image)+gcmTagSizeBytes)
+	page[0] = setBit(setBit(0, 0), 5)
+	copy(page[1:], nonce[4:])
+	binary.BigEndian.PutUint32(page[9:], uint32(len(image)+gcmTagSizeBytes))
+	return s.encryption.aead.Seal(page, nonce, image, nil), nil
+}
+
+// returns the image the page was sealed from, a page which fails authentication is reported as ErrTampered
+func (s *tOnDiskNodeStorage) decryptPage(id uint32, raw []byte) ([]byte, error) {
+	corrupted := func(format string, args ...any) ([]byte, error) {
+		return nil, &TCorruptedPageError{PageId: id, Reason: fmt.Sprintf(format, args...)}
+	}
+	if !checkBit(raw[0], 0) {
+		return corrupted("page is not allocated")
+	}
+	if !checkBit(raw[0], 5) {
+		return corrupted("page is not encrypted")
+	}
+	length := uint64(binary.BigEndian.Uint32(raw[9:]))
+	if encryptedPageHeaderSizeBytes+length > uint64(len(raw)) {
+		return corrupted("sealed image of [%v] bytes does not fit into the page", length)
+	}
+	nonce := binary.BigEndian.AppendUint32(nil, id)
+	nonce = append(nonce, raw[1:9]...)
+	image, err := s.encryption.aead.Open(nil, nonce, raw[encryptedPageHeaderSizeBytes:encryptedPageHeaderSizeBytes+length], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: page [%v]", ErrTampered, id)
+	}
+	if len(image) == 0 || (!checkBit(image[0], 4) && uint32(len(image)) != s.config.NodeSizeBytes()) {
+		return corrupted("sealed image of [%v] bytes is not a page", len(image))
+	}
+	return image, nil
+}
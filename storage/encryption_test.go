@@ -0,0 +1,177 @@
+package storage_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func testKeyProvider(t *testing.T, key string) storage.IKeyProvider {
+	t.Setenv("BTREE_TEST_KEY", key)
+	return storage.MakeEnvKeyProvider("BTREE_TEST_KEY")
+}
+
+func keyFileProvider(t *testing.T, key string) storage.IKeyProvider {
+	path := filepath.Join(t.TempDir(), "key")
+	require.Empty(t, os.WriteFile(path, []byte(key+"\n"), 0600))
+	return storage.MakeFileKeyProvider(path)
+}
+
+// the file does not hold keys or values in clear and is readable with the key from any provider
+func TestEncryption(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), KeyProvider: testKeyProvider(t, testKey)}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Equal(t, storage.FeatureEncryption, strg.Config().Features&storage.FeatureEncryption)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(500)
+	values := jsonValues(keys)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	checkStored(t, tree, keys, values)
+	require.Empty(t, strg.Close())
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	for i := range keys {
+		require.False(t, bytes.Contains(data, keys[i]))
+		require.False(t, bytes.Contains(data, values[i]))
+	}
+
+	config.KeyProvider = keyFileProvider(t, testKey)
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	checkStored(t, tree, keys, values)
+	more, _ := manyKeys(700)
+	for _, key := range more[500:] {
+		require.Empty(t, tree.Put(key, key))
+	}
+	checkStored(t, tree, keys, values)
+	checkStored(t, tree, more[500:], more[500:])
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), KeyProvider: testKeyProvider(t, testKey)}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Empty(t, strg.Close())
+
+	wrong := config
+	wrong.KeyProvider = keyFileProvider(t, "ff"+testKey[2:])
+	_, err = storage.MakeNodeStorage(wrong)
+	require.ErrorIs(t, err, storage.ErrWrongKey)
+
+	withoutKey := config
+	withoutKey.KeyProvider = nil
+	_, err = storage.MakeNodeStorage(withoutKey)
+	require.ErrorIs(t, err, storage.ErrIncompatible)
+
+	plain := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName()}
+	defer os.Remove(plain.FilePath)
+	strg, err = storage.MakeNodeStorage(plain)
+	require.Empty(t, err)
+	require.Empty(t, strg.Close())
+	plain.KeyProvider = config.KeyProvider
+	_, err = storage.MakeNodeStorage(plain)
+	require.ErrorIs(t, err, storage.ErrIncompatible)
+
+	// a key of a wrong size fails before the file is created
+	invalid := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), KeyProvider: keyFileProvider(t, "0011")}
+	_, err = storage.MakeNodeStorage(invalid)
+	require.NotEmpty(t, err)
+	exists, err := os.Stat(invalid.FilePath)
+	require.Nil(t, exists)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// a changed byte of a page fails authentication, as does a page copied to another id
+func TestTamperedPage(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), KeyProvider: testKeyProvider(t, testKey)}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(200)
+	values := jsonValues(keys)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	root := strg.RootNode()
+	require.False(t, root.IsLeaf())
+	rootId, childId := root.Id(), root.Child(0)
+	require.Empty(t, strg.Close())
+	original, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	page := func(data []byte, id uint32) []byte {
+		offset := 64 + int(id*config.PageSizeBytes)
+		return data[offset : offset+int(config.PageSizeBytes)]
+	}
+
+	tampered := append([]byte{}, original...)
+	page(tampered, rootId)[config.PageSizeBytes/2] ^= 0x01
+	require.Empty(t, os.WriteFile(config.FilePath, tampered, 0644))
+	_, err = storage.MakeNodeStorage(config)
+	require.ErrorIs(t, err, storage.ErrTampered)
+	require.NotErrorIs(t, err, storage.ErrCorrupted)
+
+	moved := append([]byte{}, original...)
+	copy(page(moved, childId), page(original, root.Child(1)))
+	require.Empty(t, os.WriteFile(config.FilePath, moved, 0644))
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	_, err = strg.LoadNode(childId)
+	require.ErrorIs(t, err, storage.ErrTampered)
+}
+
+func TestEncryptionCompressed(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 16 * 1024, FilePath: "./" + fileName(), PageCodec: storage.CodecFlate, KeyProvider: testKeyProvider(t, testKey)}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(2000)
+	values := jsonValues(keys)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	require.Greater(t, strg.Statistics().CompressedPages, uint64(0))
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, values)
+}
+
+func TestCrashRecoveryEncrypted(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), BufferPoolBytes: 512 * 8, WriteAheadLog: true, KeyProvider: testKeyProvider(t, testKey)}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	})
+}
+
+func TestPutFailureAtomicEncrypted(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), MaxCellsCount: 5, KeyProvider: testKeyProvider(t, testKey)}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTree(strg, 5)
+	})
+}
+
+func TestCrashRecoveryCopyOnWriteEncrypted(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), CopyOnWrite: true, KeyProvider: testKeyProvider(t, testKey)}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	})
+}
@@ -0,0 +1,15 @@
+package storage
+
+// fault is called before every write, a returned error fails the write
+func SetWriteFault(s INodeStorage, fault func(data []byte, offset int64) error) {
+	s.(*tOnDiskNodeStorage).writeFault = fault
+}
+
+// takes a page from the free pages without saving a node to it
+func AllocatePage(s INodeStorage) (uint32, error) {
+	node, err := s.(*tOnDiskNodeStorage).allocateNode(true, nil)
+	if err != nil {
+		return InvalidNodeId, err
+	}
+	return node.Id(), nil
+}
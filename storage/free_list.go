@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+Free pages are chained: each of them holds the id of the next one and the header holds the first one,
+so opening a file reads neither of them. Pages are taken from and returned to the head of the chain
+by the operation in progress, so a rollback restores the chain together with the pages.
+*/
+
+/******************* PUBLIC *******************/
+// returns the page of a node which is no longer referenced by the tree to the free pages
+func (s *tOnDiskNodeStorage) FreeNode(id uint32) error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.snapshotOf != nil {
+		return ErrReadOnly
+	}
+	if s.rootNode != nil && id == s.rootNode.Id() {
+		return errors.New("root node can not be freed")
+	}
+	if id >= s.nextPageId {
+		return fmt.Errorf("page [%v] does not exist", id)
+	}
+	if s.shadow != nil {
+		return s.freeShadowPage(id)
+	}
+	if s.pool != nil {
+		if err := s.forgetPage(id); err != nil {
+			return err
+		}
+	}
+	s.forgetSaved(id)
+	if err := s.writeAt(encodeFreePage(s.freeListHead), s.pageOffset(id)); err != nil {
+		return err
+	}
+	s.freeLinks[id] = s.freeListHead
+	s.freeListHead = id
+	return s.writeHeader()
+}
+
+/*
+Chains the free pages of the file at config.FilePath again from the flags of all pages, for files whose
+chain was damaged, so allocations fail with TCorruptedPageError. The chain is rewritten by a single operation,
+so a failed repair leaves it as it was. Files of layout versions 1 and 2 and copy-on-write files rebuild
+their free pages on every open, they are left as they are.
+*/
+func RepairFreeList(config TConfig) error {
+	opened, err := MakeNodeStorage(config)
+	if err != nil {
+		return err
+	}
+	s := opened.(*tOnDiskNodeStorage)
+	defer s.Close()
+	if s.layoutVersion < 3 || s.shadow != nil {
+		return nil
+	}
+	if err := s.Begin(); err != nil {
+		return err
+	}
+	err = s.rebuildFreeList()
+	if err == nil {
+		err = s.writeHeader()
+	}
+	if err != nil {
+		if rollbackErr := s.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w, rollback failed with error [%v]", err, rollbackErr)
+		}
+		return err
+	}
+	if err := s.Commit(); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+/******************* PRIVATE *******************/
+func encodeFreePage(next uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{0}, next)
+}
+
+func (s *tOnDiskNodeStorage) popFreePage() (uint32, error) {
+	if s.freeListHead == InvalidNodeId {
+		if err := s.allocateNewBatch(); err != nil {
+			return InvalidNodeId, err
+		}
+	}
+	id := s.freeListHead
+	next, err := s.freeLink(id)
+	if err != nil {
+		return InvalidNodeId, err
+	}
+	delete(s.freeLinks, id)
+	s.freeListHead = next
+	if s.rootNode == nil {
+		// the header of a new file is written along with its root
+		return id, nil
+	}
+	return id, s.writeHeader()
+}
+
+// links of pages freed after the file was opened are known, the others are read from the pages
+func (s *tOnDiskNodeStorage) freeLink(id uint32) (uint32, error) {
+	if next, ok := s.freeLinks[id]; ok {
+		return next, nil
+	}
+	raw := make([]byte, freePageSizeBytes)
+	if err := s.readAt(raw, s.pageOffset(id)); err != nil {
+		return InvalidNodeId, err
+	}
+	if checkBit(raw[0], 0) {
+		return InvalidNodeId, &TCorruptedPageError{PageId: id, Reason: "free page is allocated"}
+	}
+	next := binary.BigEndian.Uint32(raw[1:])
+	if next != InvalidNodeId && next >= s.nextPageId {
+		return InvalidNodeId, &TCorruptedPageError{PageId: id, Reason: fmt.Sprintf("next free page [%v] does not exist", next)}
+	}
+	s.freeLinks[id] = next
+	return next, nil
+}
+
+// new pages are chained in the order of their ids
+func (s *tOnDiskNodeStorage) allocateNewBatch() error {
+	batchSize := uint32(100)
+	if err := s.addressPages(uint64(s.nextPageId) + uint64(batchSize)); err != nil {
+		return err
+	}
+	pageSize := int(s.config.PageSizeBytes)
+	pages := make([]byte, pageSize*int(batchSize))
+	links := make(map[uint32]uint32, batchSize)
+	for i := uint32(0); i < batchSize; i++ {
+		id := s.nextPageId + i
+		next := id + 1
+		if i == batchSize-1 {
+			next = s.freeListHead
+		}
+		copy(pages[int(i)*pageSize:], encodeFreePage(next))
+		links[id] = next
+	}
+	if err := s.writeAt(pages, s.pageOffset(s.nextPageId)); err != nil {
+		return err
+	}
+	for id, next := range links {
+		s.freeLinks[id] = next
+	}
+	s.freeListHead = s.nextPageId
+	s.nextPageId += batchSize
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) loadFreeList() error {
+	if s.shadow != nil {
+		return s.loadShadowPages()
+	}
+	size, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	headerSize := int64(s.headerSizeBytes())
+	if (size-headerSize)%int64(s.config.PageSizeBytes) != 0 {
+		return fmt.Errorf("%w: invalid size [%v] of the file [%v]", ErrCorrupted, size, s.config.FilePath)
+	}
+	pageCount := (size - headerSize) / int64(s.config.PageSizeBytes)
+	if pageCount >= int64(InvalidNodeId) {
+		return fmt.Errorf("%w: [%v] pages of the file [%v] exceed page ids", ErrCorrupted, pageCount, s.config.FilePath)
+	}
+	s.nextPageId = uint32(pageCount)
+	if s.config.Features&FeatureFreeList != 0 {
+		if s.freeListHead != InvalidNodeId && s.freeListHead >= s.nextPageId {
+			return fmt.Errorf("%w: first free page [%v] does not exist", ErrCorrupted, s.freeListHead)
+		}
+		return nil
+	}
+	return s.rebuildFreeList()
+}
+
+/*
+Scans the flags of every page and chains the free ones. Files written before FeatureFreeList are
+upgraded once, files with a short header can not record the first free page and are scanned on every open.
+*/
+func (s *tOnDiskNodeStorage) rebuildFreeList() error {
+	s.freeListHead = InvalidNodeId
+	s.freeLinks = map[uint32]uint32{}
+	pageFlags := make([]byte, 1)
+	for pageId := s.nextPageId; pageId > 0; pageId-- {
+		if err := s.readAt(pageFlags, s.pageOffset(pageId-1)); err != nil {
+			return err
+		}
+		if !checkBit(pageFlags[0], 0) {
+			s.freeLinks[pageId-1] = s.freeListHead
+			s.freeListHead = pageId - 1
+		}
+	}
+	if s.layoutVersion < 3 {
+		return nil
+	}
+	for id, next := range s.freeLinks {
+		if err := s.writeAt(encodeFreePage(next), s.pageOffset(id)); err != nil {
+			return err
+		}
+	}
+	return s.enableFeatures(FeatureFreeList)
+}
+
+func copyLinks(links map[uint32]uint32) map[uint32]uint32 {
+	copied := make(map[uint32]uint32, len(links))
+	for id, next := range links {
+		copied[id] = next
+	}
+	return copied
+}
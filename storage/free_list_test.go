@@ -0,0 +1,139 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+func makeManyPages(t *testing.T, config storage.TConfig) {
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(2000)
+	for _, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+	}
+	require.Empty(t, strg.Close())
+}
+
+// the header and the root page are read, but not the other pages
+func TestOpenReadsHeaderAndRoot(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	makeManyPages(t, config)
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	require.Equal(t, uint64(3), strg.Statistics().ReadCalls)
+}
+
+func TestFreeNode(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	oldRootId := s1.RootNode().Id()
+	root, err := s1.AllocateRootNode()
+	require.Empty(t, err)
+	require.Empty(t, root.Save())
+	require.Error(t, s1.FreeNode(root.Id()))
+
+	// a rolled back free keeps the page allocated
+	require.Empty(t, s1.Begin())
+	require.Empty(t, s1.FreeNode(oldRootId))
+	require.Empty(t, s1.Rollback())
+	next, err := s1.AllocateRootNode()
+	require.Empty(t, err)
+	require.NotEqual(t, oldRootId, next.Id())
+	require.Empty(t, next.Save())
+
+	require.Empty(t, s1.FreeNode(oldRootId))
+	require.Empty(t, s1.Close())
+
+	s2, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s2.Close()
+	reused, err := s2.AllocateRootNode()
+	require.Empty(t, err)
+	require.Equal(t, oldRootId, reused.Id())
+}
+
+// files written before the free list are scanned once and upgraded
+func TestFreeListUpgrade(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	makeManyPages(t, config)
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	features := binary.BigEndian.Uint32(data[24:])
+	binary.BigEndian.PutUint32(data[24:], features&^storage.FeatureFreeList)
+	binary.BigEndian.PutUint32(data[36:], 0)
+	require.Empty(t, os.WriteFile(config.FilePath, data, 0644))
+
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Equal(t, features, s1.Config().Features)
+	require.Greater(t, s1.Statistics().ReadCalls, uint64(100))
+	require.Empty(t, s1.Close())
+
+	s2, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s2.Close()
+	require.Equal(t, uint64(3), s2.Statistics().ReadCalls)
+	tree := btree.MakePagedBTreeWithConfig(s2, btree.TConfig{})
+	keys, _ := manyKeys(2000)
+	checkStored(t, tree, keys, keys)
+	for i := 0; i < 500; i++ {
+		key := []byte{'z', byte(i >> 8), byte(i)}
+		require.Empty(t, tree.Put(key, key))
+	}
+	checkStored(t, tree, keys, keys)
+}
+
+// a chain pointing at an allocated page fails allocations until it is repaired
+func TestRepairFreeList(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	keys, _ := manyKeys(500)
+	makeFragmented(t, config, keys)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	rootId := strg.RootNode().Id()
+	require.Empty(t, strg.Close())
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	binary.BigEndian.PutUint32(data[36:], rootId)
+	require.Empty(t, os.WriteFile(config.FilePath, data, 0644))
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	_, err = storage.AllocatePage(strg)
+	var corrupted *storage.TCorruptedPageError
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, rootId, corrupted.PageId)
+	require.Empty(t, strg.Close())
+
+	require.Empty(t, storage.RepairFreeList(config))
+	before, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	checkStored(t, tree, keys, keys)
+	// the freed pages are reused before the file grows
+	for i := 0; i < len(keys)/10; i++ {
+		_, err := storage.AllocatePage(strg)
+		require.Empty(t, err)
+	}
+	after, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	require.Equal(t, before.Size(), after.Size())
+	checkStored(t, tree, keys, keys)
+}
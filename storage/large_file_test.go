@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+func headerLayoutVersion(t *testing.T, filePath string) uint32 {
+	file, err := os.Open(filePath)
+	require.Empty(t, err)
+	defer file.Close()
+	header := make([]byte, 8)
+	_, err = file.ReadAt(header, 0)
+	require.Empty(t, err)
+	return binary.BigEndian.Uint32(header[4:])
+}
+
+func setHeaderLayoutVersion(t *testing.T, filePath string, version uint32) {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	require.Empty(t, err)
+	defer file.Close()
+	_, err = file.WriteAt(binary.BigEndian.AppendUint32(nil, version), 4)
+	require.Empty(t, err)
+}
+
+// pages up to the given id are left as holes, so the pages allocated next are addressed past 4GiB
+func extendSparse(t *testing.T, filePath string, pageSize uint32, id uint32) {
+	require.Empty(t, os.Truncate(filePath, 64+int64(pageSize)*int64(id)))
+	info, err := os.Stat(filePath)
+	require.Empty(t, err)
+	if allocated, ok := allocatedBytes(info); !ok || allocated > info.Size()/2 {
+		t.Skip("sparse files are not supported")
+	}
+}
+
+// a file of layout version 3 keeps it while it is small and is raised to version 4 once it grows past 4GiB
+func TestLargeFile(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 4096, FilePath: "./" + fileName()}
+	defer os.Remove(config.FilePath)
+	keys, _ := manyKeys(3000)
+	values := jsonValues(keys)
+	put := func(from, to int) {
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+		for i := from; i < to; i++ {
+			require.Empty(t, tree.Put(keys[i], values[i]))
+		}
+		checkStored(t, tree, keys[:to], values[:to])
+		require.Empty(t, strg.Close())
+	}
+	put(0, 100)
+	require.Equal(t, storage.FileLayoutVersion, headerLayoutVersion(t, config.FilePath))
+	setHeaderLayoutVersion(t, config.FilePath, 3)
+	put(100, 200)
+	require.Equal(t, uint32(3), headerLayoutVersion(t, config.FilePath))
+
+	highId := uint32((1 << 32) / int64(config.PageSizeBytes))
+	extendSparse(t, config.FilePath, config.PageSizeBytes, highId)
+	put(200, len(keys))
+	require.Equal(t, storage.FileLayoutVersion, headerLayoutVersion(t, config.FilePath))
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, values)
+	root := strg.RootNode()
+	high := 0
+	for i := 0; i <= root.KeyCount(); i++ {
+		if root.Child(i) >= highId {
+			high++
+		}
+	}
+	require.Greater(t, high, 0)
+	require.Greater(t, strg.Statistics().BytesRead, uint64(0))
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+/******************* PUBLIC *******************/
+/*
+Rewrites the file at config.FilePath in the current layout with page checksums, key prefixes in the slots
+and chained free pages, files of layout versions 1 and 2 get the full header. Pages keep their ids, so the tree
+is not restructured, but cells are packed again to make room for the checksum and the prefixes. The original file
+is replaced only once the copy is complete and synced, a page without room for them fails the migration.
+Copy-on-write, compressed and encrypted files are written with checksums from the start, their pages
+keep slots without prefixes.
+*/
+func Migrate(config TConfig) error {
+	if config.Device != nil {
+		return errors.New("migration requires a file")
+	}
+	opened, err := MakeNodeStorage(config)
+	if err != nil {
+		return err
+	}
+	source := opened.(*tOnDiskNodeStorage)
+	defer source.Close()
+	// files of layout version 3 differ only in offsets, which are raised to version 4 once the file grows
+	if source.layoutVersion >= 3 && source.config.Features&FeatureChecksums != 0 {
+		if source.config.Features&(FeatureKeyPrefixes|FeatureCopyOnWrite|FeatureCompression|FeatureEncryption) != 0 {
+			return nil
+		}
+	}
+	migratedPath := config.FilePath + ".migrate"
+	file, err := os.Create(migratedPath)
+	if err != nil {
+		return err
+	}
+	target := &tOnDiskNodeStorage{
+		config:        source.config,
+		rootNode:      source.rootNode,
+		device:        &tFileDevice{file: file},
+		nextPageId:    source.nextPageId,
+		freeListHead:  InvalidNodeId,
+		stats:         &TStorageStatistics{},
+		layoutVersion: FileLayoutVersion,
+	}
+	target.config.Features |= FeatureChecksums | FeatureKeyPrefixes
+	if err := source.migratePages(target); err != nil {
+		file.Close()
+		os.Remove(migratedPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(migratedPath)
+		return err
+	}
+	if err := source.Close(); err != nil {
+		os.Remove(migratedPath)
+		return err
+	}
+	return os.Rename(migratedPath, config.FilePath)
+}
+
+/******************* PRIVATE *******************/
+func (s *tOnDiskNodeStorage) migratePages(target *tOnDiskNodeStorage) error {
+	if s.pool != nil {
+		if err := s.flushPool(); err != nil {
+			return err
+		}
+	}
+	if err := target.device.Truncate(target.pageOffset(target.nextPageId)); err != nil {
+		return err
+	}
+	free := map[uint32]bool{}
+	for id := s.freeListHead; id != InvalidNodeId; {
+		free[id] = true
+		next, err := s.freeLink(id)
+		if err != nil {
+			return err
+		}
+		id = next
+	}
+	raw := make([]byte, s.config.PageSizeBytes)
+	for id := uint32(0); id < s.nextPageId; id++ {
+		if free[id] {
+			continue
+		}
+		if err := s.readAt(raw, s.pageOffset(id)); err != nil {
+			return err
+		}
+		node, err := s.decodePage(id, raw)
+		if err != nil {
+			return err
+		}
+		node.parent = target
+		if len(node.messages) > 0 {
+			target.config.Features |= FeatureMessages
+		}
+		if err := node.defragment(); err != nil {
+			return fmt.Errorf("failed to migrate page [%v], error [%w]", id, err)
+		}
+	}
+	if err := target.rebuildFreeList(); err != nil {
+		return err
+	}
+	if err := target.writeHeader(); err != nil {
+		return err
+	}
+	return target.device.Sync()
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+With TConfig.MemoryMapped nodes are decoded straight from a shared read-only mapping of the file,
+so a load neither allocates a page nor makes a syscall. Writes still go through the file and are seen
+through the mapping, as both use the page cache. Cells of a loaded node reference the mapping, so they are
+copied before the node is changed or defragmented, and values are copied when they are handed out.
+Once the file outgrows the mapping it is mapped again with twice the size, the smaller mappings are
+kept until the storage is closed, as nodes loaded earlier may reference them.
+*/
+
+/******************* PRIVATE *******************/
+func makeMapping(enabled bool) *tMapping {
+	if !enabled {
+		return nil
+	}
+	return &tMapping{}
+}
+
+// the page is sliced from the mapping, the file is mapped again if it grew past the mapping
+func (s *tOnDiskNodeStorage) mappedPage(id uint32) ([]byte, error) {
+	start := s.pageOffset(id)
+	end := start + int64(s.config.PageSizeBytes)
+	if end > s.mapping.size {
+		if err := s.remap(end); err != nil {
+			return nil, err
+		}
+	}
+	s.stats.ReadCalls += 1
+	s.stats.BytesRead += uint64(s.config.PageSizeBytes)
+	return s.mapping.data[start:end:end], nil
+}
+
+func (s *tOnDiskNodeStorage) remap(required int64) error {
+	size, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	if size < required {
+		return fmt.Errorf("failed to read, error [%w]", io.ErrUnexpectedEOF)
+	}
+	if size <= int64(len(s.mapping.data)) {
+		s.mapping.size = size
+		return nil
+	}
+	length := 2 * int64(len(s.mapping.data))
+	if length < size {
+		length = size
+	}
+	data, err := mmapFile(s.osFile(), length)
+	if err != nil {
+		return fmt.Errorf("failed to map the file [%v], error [%w]", s.config.FilePath, err)
+	}
+	if s.mapping.data != nil {
+		s.mapping.retired = append(s.mapping.retired, s.mapping.data)
+	}
+	s.mapping.data = data
+	s.mapping.size = size
+	return nil
+}
+
+// a read from the mapping past the end of the file would fault, so the truncated pages are not read
+func (s *tOnDiskNodeStorage) truncateFile(size int64) error {
+	if err := s.syncWal(); err != nil {
+		return err
+	}
+	if err := s.device.Truncate(size); err != nil {
+		return err
+	}
+	if s.mapping != nil && size < s.mapping.size {
+		s.mapping.size = size
+	}
+	return nil
+}
+
+// the root stays readable after closing, other nodes must not be used
+func (s *tOnDiskNodeStorage) closeMapping() error {
+	if root, ok := s.rootNode.(*tNode); ok {
+		root.detach()
+	}
+	var err error
+	for _, data := range append(s.mapping.retired, s.mapping.data) {
+		if data == nil {
+			continue
+		}
+		if unmapErr := munmapFile(data); err == nil {
+			err = unmapErr
+		}
+	}
+	s.mapping = makeMapping(true)
+	return err
+}
+
+// copies the cells out of the mapping
+func (node *tNode) detach() {
+	if !node.mapped {
+		return
+	}
+	for _, cell := range node.cells() {
+		cell.key = append([]byte{}, cell.key...)
+		if cell.value != nil {
+			cell.value = append([]byte{}, cell.value...)
+		}
+	}
+	node.mapped = false
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, length int64) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
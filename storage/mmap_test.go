@@ -0,0 +1,64 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+// the file grows past the mapping many times, values handed out do not change with the pages
+func TestMemoryMapped(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), MemoryMapped: true}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{Redistribute: true})
+	keys, values := manyKeys(2000)
+	for i := range keys {
+		values[i] = []byte(fmt.Sprintf("value %v", i))
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	checkStored(t, tree, keys, values)
+	held, err := tree.Get(keys[0])
+	require.Empty(t, err)
+	for i := range keys {
+		require.Empty(t, tree.Put(keys[i], []byte(fmt.Sprintf("new value %v", i))))
+	}
+	require.Equal(t, values[0], held)
+	readCalls := strg.Statistics().ReadCalls
+	_, err = tree.Get(keys[len(keys)-1])
+	require.Empty(t, err)
+	require.Greater(t, strg.Statistics().ReadCalls, readCalls)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	for i := range keys {
+		values[i] = []byte(fmt.Sprintf("new value %v", i))
+	}
+	checkStored(t, tree, keys, values)
+}
+
+func TestPutFailureAtomicMemoryMapped(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), MemoryMapped: true}
+	checkPutFailureAtomic(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{Redistribute: true})
+	})
+}
+
+func TestCompactMemoryMapped(t *testing.T) {
+	checkCompact(t, storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), MemoryMapped: true, BufferPoolBytes: 256 * 16})
+}
+
+func TestCrashRecoveryCopyOnWriteMemoryMapped(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), CopyOnWrite: true, MemoryMapped: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakeBufferedBTree(strg)
+	})
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -42,7 +43,32 @@ func (node *tNode) KeyFull(id int) ([]byte, error) {
 	return key, nil
 }
 
+/*
+Binary search over the slots. Prefixes of the keys are compared first, keys themselves only when
+the prefixes are equal, so most comparisons do not read the cells, which may be in the memory mapping.
+With FeatureKeyPrefixes the prefixes are decoded from the slots, otherwise they are taken from the keys.
+*/
+func (node *tNode) Search(key []byte) (int, bool) {
+	prefix := keyPrefix(key)
+	idx := sort.Search(len(node.tuples), func(i int) bool {
+		tuple := node.tuples[i]
+		if tuple.prefix != prefix {
+			return tuple.prefix > prefix
+		}
+		return bytes.Compare(tuple.key, key) != -1
+	})
+	if idx == len(node.tuples) {
+		return idx, false
+	}
+	tuple := node.tuples[idx]
+	return idx, tuple.prefix == prefix && bytes.Equal(tuple.key, key)
+}
+
+// values of a node decoded from the memory mapping are copied, as the page may be overwritten later
 func (node *tNode) Value(id int) []byte {
+	if node.mapped {
+		return append([]byte{}, node.tuples[id].value...)
+	}
 	return node.tuples[id].value
 }
 
@@ -61,6 +87,7 @@ func (node *tNode) InsertKey(key []byte, idx int) {
 }
 
 func (p *tNode) InsertChild(childId uint32, idx int) {
+	p.beforeChange()
 	if idx == len(p.children) {
 		p.children = append(p.children, childId)
 		return
@@ -70,6 +97,7 @@ func (p *tNode) InsertChild(childId uint32, idx int) {
 }
 
 func (lhs *tNode) SplitAt(pivotKeyIdx int) (INode, error) {
+	lhs.beforeChange()
 	rhsChildren := []uint32{InvalidNodeId}
 	if !lhs.IsLeaf() {
 		rhsChildren = append(rhsChildren, lhs.children[pivotKeyIdx+1:]...)
@@ -83,7 +111,7 @@ func (lhs *tNode) SplitAt(pivotKeyIdx int) (INode, error) {
 	if !ok {
 		return nil, errors.New("downcast failed")
 	}
-	rhsCasted.tuples = lhs.tuples[pivotKeyIdx:]
+	rhsCasted.tuples = append([]*tTuple{}, lhs.tuples[pivotKeyIdx:]...)
 	lhs.tuples = lhs.tuples[:pivotKeyIdx]
 	for _, tuple := range rhsCasted.tuples {
 		tuple.offsets = nil
@@ -92,6 +120,7 @@ func (lhs *tNode) SplitAt(pivotKeyIdx int) (INode, error) {
 }
 
 func (node *tNode) InsertKeyValue(key []byte, value []byte, idx int) {
+	node.beforeChange()
 	tuple := makeTuple(key, value)
 	if idx == node.KeyCount() {
 		node.tuples = append(node.tuples, tuple)
@@ -101,7 +130,60 @@ func (node *tNode) InsertKeyValue(key []byte, value []byte, idx int) {
 	node.tuples[idx] = tuple
 }
 
+func (node *tNode) UsedBytes() uint32 {
+	return node.usedBytes()
+}
+
+func (node *tNode) MessageCount() int {
+	return len(node.messages)
+}
+
+func (node *tNode) Message(idx int) TMessage {
+	message := node.messages[idx]
+	if node.mapped {
+		return TMessage{Kind: message.kind, Key: append([]byte{}, message.key...), Value: append([]byte{}, message.value...)}
+	}
+	return TMessage{Kind: message.kind, Key: message.key, Value: message.value}
+}
+
+// bytes of the page occupied by a message, including its offsets
+func (node *tNode) MessageSize(idx int) uint32 {
+	return 8 + node.messages[idx].sizeBytes()
+}
+
+func (node *tNode) InsertMessage(message TMessage, idx int) {
+	node.beforeChange()
+	tuple := &tTuple{kind: message.Kind, key: message.Key, value: message.Value}
+	node.messages = append(node.messages, nil)
+	copy(node.messages[idx+1:], node.messages[idx:])
+	node.messages[idx] = tuple
+}
+
+func (node *tNode) RemoveMessage(idx int) {
+	node.beforeChange()
+	node.messages = append(node.messages[:idx], node.messages[idx+1:]...)
+	node.calculateFreeOffsets()
+}
+
+// only for leaves, internal nodes would also have to drop a child
+func (node *tNode) RemoveKeyValue(idx int) {
+	node.beforeChange()
+	node.tuples = append(node.tuples[:idx], node.tuples[idx+1:]...)
+	node.calculateFreeOffsets()
+}
+
+func (node *tNode) UpdateKey(idx int, key []byte) {
+	node.beforeChange()
+	if node.tuples[idx].offsets != nil {
+		node.tuples[idx].offsets = nil
+		node.calculateFreeOffsets()
+	}
+	node.tuples[idx].key = key
+	node.tuples[idx].prefix = keyPrefix(key)
+}
+
 func (node *tNode) UpdateValue(idx int, value []byte) {
+	node.beforeChange()
 	if node.tuples[idx].offsets != nil {
 		node.tuples[idx].offsets = nil
 		node.calculateFreeOffsets()
@@ -109,24 +191,50 @@ func (node *tNode) UpdateValue(idx int, value []byte) {
 	node.tuples[idx].value = value
 }
 
+func (node *tNode) TupleSize(idx int) uint32 {
+	return node.slotSizeBytes() + tupleSizeBytes(node.tuples[idx].key, node.tuples[idx].value)
+}
+
+func (node *tNode) Fits(keySize, valueSize int) bool {
+	if node.isLeaf {
+		keySize += valueSize
+	}
+	tupleSize := uint32(4 + keySize)
+	if tupleSize > node.parent.config.MaxTupleSize(node.isLeaf) {
+		return false
+	}
+	if node.parent.config.MaxCellsCount != 0 {
+		return uint32(node.KeyCount()) < node.parent.config.MaxCellsCount
+	}
+	return node.usedBytes()+node.slotSizeBytes()+tupleSize <= node.parent.config.NodeSizeBytes()
+}
+
 func (node *tNode) Save() error {
-	if node.parent.file == nil {
-		return errors.New("already closed")
+	if node.parent.device == nil {
+		return ErrClosed
 	}
+	if node.generation < node.parent.compacted {
+		return ErrStaleNode
+	}
+	if len(node.messages) > 0 {
+		if err := node.parent.enableFeatures(FeatureMessages); err != nil {
+			return err
+		}
+	}
+	if node.cellsOverlapReserved() {
+		return node.defragment()
+	}
+	node.calculateFreeOffsets()
 	defragment := false
-	newTuples := []*tTuple{}
-	encoded := [][]byte{}
-	for _, tuple := range node.tuples {
+	for _, tuple := range node.cells() {
 		if tuple.offsets != nil {
 			continue
 		}
-		encodedTuple := encodeTuple(tuple.key, tuple.value)
-		newTuples = append(newTuples, tuple)
-		encoded = append(encoded, encodedTuple)
+		tupleSize := tuple.sizeBytes()
 		var i int
 		for i = len(node.freeOffsets) - 1; i >= 0; i-- {
 			intervalLen := node.freeOffsets[i].End - node.freeOffsets[i].Start
-			if intervalLen >= uint32(len(encodedTuple)) {
+			if intervalLen >= tupleSize {
 				break
 			}
 		}
@@ -135,7 +243,7 @@ func (node *tNode) Save() error {
 			break
 		}
 		newCellOffsets := tCellOffsets{
-			Start: node.freeOffsets[i].End - uint32(len(encodedTuple)),
+			Start: node.freeOffsets[i].End - tupleSize,
 			End:   node.freeOffsets[i].End,
 		}
 		if newCellOffsets.Start == node.freeOffsets[i].Start {
@@ -148,15 +256,21 @@ func (node *tNode) Save() error {
 	if defragment {
 		return node.defragment()
 	}
-	for i, tuple := range newTuples {
-		if err := node.parent.writeAt(encoded[i], int64(fileHeaderSizeBytes+node.parent.config.PageSizeBytes*node.id+tuple.offsets.Start)); err != nil {
-			return err
-		}
-	}
-	return node.parent.writeAt(node.encodeHeaderOffsetsAndChildren(), int64(fileHeaderSizeBytes+node.parent.config.PageSizeBytes*node.id))
+	return node.store()
 }
 
 /******************* PRIVATE *******************/
+/*
+Lets the buffer pool keep the node as it was before the operation in progress changed it.
+Cells of a memory mapped node are copied, so the change does not depend on the bytes of the page.
+*/
+func (node *tNode) beforeChange() {
+	node.detach()
+	if node.parent.pool != nil {
+		node.parent.touchNode(node)
+	}
+}
+
 func (r *tSliceReader) Read(buf []byte) (n int, err error) {
 	n = copy(buf, r.data[r.curPos:])
 	r.curPos += n
@@ -176,14 +290,86 @@ func encodeTuple(key, value []byte) []byte {
 	return cell
 }
 
-func (node *tNode) calculateFreeOffsets() {
-	node.freeOffsets = []tCellOffsets{}
-	reserved := pageHeaderSizeBytes + (node.parent.config.MaxCellsCount * 8)
+func tupleSizeBytes(key, value []byte) uint32 {
+	return uint32(4 + len(key) + len(value))
+}
+
+// messages are prefixed with their kind
+func (tuple *tTuple) encode() []byte {
+	if tuple.kind == 0 {
+		return encodeTuple(tuple.key, tuple.value)
+	}
+	return append([]byte{tuple.kind}, encodeTuple(tuple.key, tuple.value)...)
+}
+
+func (tuple *tTuple) sizeBytes() uint32 {
+	size := tupleSizeBytes(tuple.key, tuple.value)
+	if tuple.kind != 0 {
+		size += 1
+	}
+	return size
+}
+
+// tuples followed by messages
+func (node *tNode) cells() []*tTuple {
+	if len(node.messages) == 0 {
+		return node.tuples
+	}
+	return append(append([]*tTuple{}, node.tuples...), node.messages...)
+}
+
+// bytes of the page occupied by a single cell's offsets and, for internal nodes, by a child id
+func (node *tNode) slotSizeBytes() uint32 {
+	if node.isLeaf {
+		return node.parent.config.slotSizeBytes()
+	}
+	return node.parent.config.slotSizeBytes() + 4
+}
+
+// bytes at the start of the page reserved for the header, cell offsets and children
+func (node *tNode) reservedBytes() uint32 {
+	config := node.parent.config
+	if config.MaxCellsCount != 0 {
+		reserved := config.pageHeaderSizeBytes() + config.MaxCellsCount*config.slotSizeBytes()
+		if !node.isLeaf {
+			reserved += (config.MaxCellsCount + 1) * 4
+		}
+		return reserved
+	}
+	reserved := config.pageHeaderSizeBytes() + uint32(len(node.tuples))*config.slotSizeBytes()
 	if !node.isLeaf {
-		reserved += (node.parent.config.MaxCellsCount + 1) * 4
+		reserved += uint32(len(node.children)) * 4
+	}
+	if len(node.messages) > 0 {
+		reserved += 4 + uint32(len(node.messages))*8
+	}
+	return reserved
+}
+
+func (node *tNode) usedBytes() uint32 {
+	used := node.reservedBytes()
+	for _, tuple := range node.cells() {
+		used += tuple.sizeBytes()
+	}
+	return used
+}
+
+// with a variable number of cells the reserved area grows and may reach cells written earlier
+func (node *tNode) cellsOverlapReserved() bool {
+	reserved := node.reservedBytes()
+	for _, tuple := range node.cells() {
+		if tuple.offsets != nil && tuple.offsets.Start < reserved {
+			return true
+		}
 	}
+	return false
+}
+
+func (node *tNode) calculateFreeOffsets() {
+	node.freeOffsets = []tCellOffsets{}
+	reserved := node.reservedBytes()
 	cellOffsets := []*tCellOffsets{}
-	for _, tuple := range node.tuples {
+	for _, tuple := range node.cells() {
 		if tuple.offsets != nil {
 			cellOffsets = append(cellOffsets, tuple.offsets)
 		}
@@ -198,18 +384,26 @@ func (node *tNode) calculateFreeOffsets() {
 		}
 		prevEnd = cellOffsets.End
 	}
-	if prevEnd != node.parent.config.PageSizeBytes {
-		node.freeOffsets = append(node.freeOffsets, tCellOffsets{Start: prevEnd, End: node.parent.config.PageSizeBytes})
+	if prevEnd != node.parent.config.NodeSizeBytes() {
+		node.freeOffsets = append(node.freeOffsets, tCellOffsets{Start: prevEnd, End: node.parent.config.NodeSizeBytes()})
 	}
 }
 
 func makeTuple(key, value []byte) *tTuple {
 	return &tTuple{
-		key:   key,
-		value: value,
+		key:    key,
+		prefix: keyPrefix(key),
+		value:  value,
 	}
 }
 
+// a key shorter than the prefix is padded with zeroes, so equal prefixes do not mean equal keys
+func keyPrefix(key []byte) uint64 {
+	var prefix [keyPrefixSizeBytes]byte
+	copy(prefix[:], key)
+	return binary.BigEndian.Uint64(prefix[:])
+}
+
 func setBit(flags byte, idx int) byte {
 	var mask byte = 1
 	mask = mask << (7 - idx)
@@ -222,47 +416,92 @@ func (node *tNode) encodeHeaderOffsetsAndChildren() []byte {
 	if node.isLeaf {
 		flags = setBit(flags, 1)
 	}
+	if len(node.messages) > 0 {
+		flags = setBit(flags, 2)
+	}
 	buf := []byte{flags}
 	buf = binary.BigEndian.AppendUint32(buf, uint32(len(node.tuples)))
+	checksums := node.parent.config.Features&FeatureChecksums != 0
+	if checksums {
+		buf = binary.BigEndian.AppendUint32(buf, 0)
+	}
+	prefixes := node.parent.config.Features&FeatureKeyPrefixes != 0
 	for _, tuple := range node.tuples {
 		buf = binary.BigEndian.AppendUint32(buf, tuple.offsets.Start)
 		buf = binary.BigEndian.AppendUint32(buf, tuple.offsets.End)
+		if prefixes {
+			buf = binary.BigEndian.AppendUint64(buf, tuple.prefix)
+		}
 	}
-	if node.isLeaf {
-		return buf
+	if !node.isLeaf {
+		for _, child := range node.children {
+			buf = binary.BigEndian.AppendUint32(buf, child)
+		}
 	}
-	for _, child := range node.children {
-		buf = binary.BigEndian.AppendUint32(buf, child)
+	if len(node.messages) > 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(node.messages)))
+		for _, message := range node.messages {
+			buf = binary.BigEndian.AppendUint32(buf, message.offsets.Start)
+			buf = binary.BigEndian.AppendUint32(buf, message.offsets.End)
+		}
+	}
+	if checksums {
+		cells := [][]byte{}
+		for _, cell := range node.cells() {
+			cells = append(cells, cell.encode())
+		}
+		binary.BigEndian.PutUint32(buf[pageHeaderSizeBytes:], pageChecksum(buf, cells))
 	}
 	return buf
 }
 
-func maxTupleSize(config TConfig, isLeaf bool) uint32 {
-	reserved := pageHeaderSizeBytes + config.MaxCellsCount*8
-	if !isLeaf {
-		reserved += (config.MaxCellsCount + 1) * 4
+func (node *tNode) tooLargeError(tupleSize int) error {
+	if node.isLeaf {
+		return fmt.Errorf("%w: tuple of [%v] bytes", ErrValueTooLarge, tupleSize)
 	}
-	dataSpace := config.PageSizeBytes - reserved
-	return uint32(dataSpace / config.MaxCellsCount)
+	return fmt.Errorf("%w: tuple of [%v] bytes", ErrKeyTooLarge, tupleSize)
 }
 
 func (node *tNode) defragment() error {
-	overallLen := 0
-	encoded := make([][]byte, len(node.tuples))
-	for i, tuple := range node.tuples {
-		encoded[i] = encodeTuple(tuple.key, tuple.value)
-		if uint32(len(encoded[i])) > maxTupleSize(node.parent.config, node.isLeaf) {
-			return fmt.Errorf("tuple max size exceeded")
+	// cells are moved within the page
+	node.detach()
+	if node.usedBytes() > node.parent.config.NodeSizeBytes() {
+		return fmt.Errorf("%w: node does not fit into a page", ErrValueTooLarge)
+	}
+	overallLen := uint32(0)
+	for _, tuple := range node.cells() {
+		tupleSize := tuple.sizeBytes()
+		if tuple.kind == 0 && tupleSize > node.parent.config.MaxTupleSize(node.isLeaf) {
+			return node.tooLargeError(int(tupleSize))
 		}
 		tuple.offsets = &tCellOffsets{}
-		tuple.offsets.End = node.parent.config.PageSizeBytes - uint32(overallLen)
-		overallLen += len(encoded[i])
-		tuple.offsets.Start = node.parent.config.PageSizeBytes - uint32(overallLen)
+		tuple.offsets.End = node.parent.config.NodeSizeBytes() - overallLen
+		overallLen += tupleSize
+		tuple.offsets.Start = node.parent.config.NodeSizeBytes() - overallLen
+	}
+	return node.store()
+}
+
+// hands the node to the buffer pool, to the shadow pages or to the operation, otherwise writes its page
+func (node *tNode) store() error {
+	if node.parent.pool != nil {
+		return node.parent.markDirty(node)
+	}
+	if node.parent.shadow != nil {
+		return node.parent.saveShadowNode(node)
 	}
-	allEncoded := []byte{}
-	for i := len(encoded) - 1; i >= 0; i-- {
-		allEncoded = append(allEncoded, encoded[i]...)
+	if node.parent.keepSaved(node) {
+		return nil
+	}
+	return node.parent.writePages([]*tNode{node}, node.parent.writeAt)
+}
+
+// the whole page, bytes outside of cells are zeroed
+func (node *tNode) encodePage() []byte {
+	page := make([]byte, node.parent.config.NodeSizeBytes())
+	copy(page, node.encodeHeaderOffsetsAndChildren())
+	for _, tuple := range node.cells() {
+		copy(page[tuple.offsets.Start:tuple.offsets.End], tuple.encode())
 	}
-	node.parent.writeAt(allEncoded, int64(fileHeaderSizeBytes+node.parent.config.PageSizeBytes*(node.id+1)-uint32(len(allEncoded))))
-	return node.parent.writeAt(node.encodeHeaderOffsetsAndChildren(), int64(fileHeaderSizeBytes+node.parent.config.PageSizeBytes*node.id))
+	return page
 }
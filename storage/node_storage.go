@@ -1,14 +1,21 @@
 package storage
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"time"
 )
 
 /******************* PUBLIC *******************/
-const FileLayoutVersion uint32 = 1
+/*
+Versions 1 and 2 have a short header without a magic number. Version 4 has the layout of version 3,
+but pages are addressed with 64-bit offsets, so the file may grow past 4GiB.
+*/
+const FileLayoutVersion uint32 = 4
 
 func (s *tOnDiskNodeStorage) RootNode() INode {
 	return s.rootNode
@@ -24,6 +31,10 @@ func (s *tOnDiskNodeStorage) AllocateRootNode() (INode, error) {
 		return nil, err
 	}
 	s.rootNode = newRoot
+	if s.shadow != nil {
+		// the root is switched by the commit
+		return newRoot, nil
+	}
 	if err := s.writeHeader(); err != nil {
 		return nil, err
 	}
@@ -31,22 +42,90 @@ func (s *tOnDiskNodeStorage) AllocateRootNode() (INode, error) {
 }
 
 func (s *tOnDiskNodeStorage) LoadNode(id uint32) (INode, error) {
-	if s.file == nil {
-		return nil, errors.New("already closed")
+	if s.device == nil {
+		return nil, ErrClosed
+	}
+	if s.pool != nil {
+		if node := s.cachedNode(id); node != nil {
+			return node, nil
+		}
+	}
+	if s.shadow != nil {
+		if node, ok := s.shadow.dirty[id]; ok {
+			return node, nil
+		}
+	}
+	if node := s.savedNode(id); node != nil {
+		return node, nil
+	}
+	var raw []byte
+	if s.mapping != nil {
+		var err error
+		if raw, err = s.mappedPage(id); err != nil {
+			return nil, err
+		}
+	} else {
+		raw = make([]byte, s.config.PageSizeBytes)
+		if err := s.readAt(raw, s.pageOffset(id)); err != nil {
+			return nil, err
+		}
+	}
+	node, err := s.decodePage(id, raw)
+	if err != nil {
+		return nil, err
+	}
+	node.mapped = s.mapping != nil && !node.decoded
+	if s.pool != nil {
+		if err := s.cacheNode(node, false); err != nil {
+			return nil, err
+		}
 	}
-	raw := make([]byte, s.config.PageSizeBytes)
-	if err := s.readAt(raw, int64(s.config.PageSizeBytes*id+fileHeaderSizeBytes)); err != nil {
+	if s.shadow != nil && s.undo != nil {
+		s.shadow.loaded = append(s.shadow.loaded, node)
+	}
+	return node, nil
+}
+
+// fails without reading once ctx is done
+func (s *tOnDiskNodeStorage) LoadNodeContext(ctx context.Context, id uint32) (INode, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return s.makeNodeFromRaw(id, raw)
+	return s.LoadNode(id)
 }
 
+// dirty pages of the buffer pool are written back before closing, the write-ahead log is checkpointed
 func (s *tOnDiskNodeStorage) Close() error {
-	if s.file == nil {
+	if s.device == nil {
 		return nil
 	}
-	err := s.file.Close()
-	s.file = nil
+	if s.snapshotOf != nil {
+		return s.closeSnapshot()
+	}
+	if s.durability != nil {
+		s.durability.close()
+	}
+	var err error
+	if s.wal != nil {
+		err = s.checkpoint()
+		if closeErr := s.wal.device.Close(); err == nil {
+			err = closeErr
+		}
+	} else if s.pool != nil {
+		err = s.flushPool()
+	}
+	if s.durability != nil && s.wal == nil && err == nil {
+		err = syncDevice(s.device, s.stats)
+	}
+	if s.mapping != nil {
+		if unmapErr := s.closeMapping(); err == nil {
+			err = unmapErr
+		}
+	}
+	if closeErr := s.device.Close(); err == nil {
+		err = closeErr
+	}
+	s.device = nil
 	return err
 }
 
@@ -54,6 +133,49 @@ func (s *tOnDiskNodeStorage) Statistics() *TStorageStatistics {
 	return s.stats
 }
 
+func (s *tOnDiskNodeStorage) Config() TConfig {
+	return s.config
+}
+
+/*
+Returns the max size of an encoded tuple (key length [4] + key + value) for a node.
+With a fixed cells count the data space is split equally between cells, otherwise
+a page has to hold at least minCellsPerPage tuples.
+*/
+func (config TConfig) MaxTupleSize(isLeaf bool) uint32 {
+	if config.MaxCellsCount == 0 {
+		slot := config.slotSizeBytes()
+		reserved := config.pageHeaderSizeBytes()
+		if !isLeaf {
+			slot += 4
+			reserved += 4
+		}
+		return (config.NodeSizeBytes()-reserved)/minCellsPerPage - slot
+	}
+	reserved := config.pageHeaderSizeBytes() + config.MaxCellsCount*config.slotSizeBytes()
+	if !isLeaf {
+		reserved += (config.MaxCellsCount + 1) * 4
+	}
+	dataSpace := config.NodeSizeBytes() - reserved
+	return uint32(dataSpace / config.MaxCellsCount)
+}
+
+// bytes of a page available to its node, pages of encrypted files keep room for their header and the tag
+func (config TConfig) NodeSizeBytes() uint32 {
+	if config.Features&FeatureEncryption != 0 {
+		return config.PageSizeBytes - encryptedPageHeaderSizeBytes - gcmTagSizeBytes
+	}
+	return config.PageSizeBytes
+}
+
+func (e *TCorruptedPageError) Error() string {
+	return fmt.Sprintf("page [%v] is corrupted: %v", e.PageId, e.Reason)
+}
+
+func (e *TCorruptedPageError) Unwrap() error {
+	return ErrCorrupted
+}
+
 func fileExists(filePath string) (bool, error) {
 	info, err := os.Stat(filePath)
 	if err == nil {
@@ -65,55 +187,283 @@ func fileExists(filePath string) (bool, error) {
 	return false, err
 }
 
+/*
+Creates a file with the given config or opens an existing one, in which case the config
+is validated against the file header and its zero fields are taken from the file.
+Copy-on-write is recorded in the file as well, so an existing file keeps the mode it was created with.
+The write-ahead log left by a previous run is replayed before the header is read, even if
+the log is disabled now.
+*/
 func MakeNodeStorage(config TConfig) (INodeStorage, error) {
-	exists, err := fileExists(config.FilePath)
+	if err := checkCopyOnWrite(config); err != nil {
+		return nil, err
+	}
+	if err := checkDurability(config); err != nil {
+		return nil, err
+	}
+	if err := checkCodec(config); err != nil {
+		return nil, err
+	}
+	if err := checkDevices(config); err != nil {
+		return nil, err
+	}
+	exists, err := storageExists(config)
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
-		file, err := os.Create(config.FilePath)
+		if config.PageSizeBytes == 0 {
+			return nil, errors.New("page size is not set")
+		}
+		encryption, err := makeEncryption(config.KeyProvider)
 		if err != nil {
 			return nil, err
 		}
+		device, err := createDevice(config)
+		if err != nil {
+			return nil, err
+		}
+		config.Features = FeatureChecksums | FeatureFreeList | FeatureKeyPrefixes
+		if config.CopyOnWrite {
+			config.Features = FeatureChecksums | FeatureCopyOnWrite | FeatureKeyPrefixes
+		}
+		if encryption != nil {
+			config.Features |= FeatureEncryption
+		}
+		config.CreatedAt = time.Unix(0, time.Now().UnixNano())
 		storage := &tOnDiskNodeStorage{
-			config:      config,
-			file:        file,
-			nextPageId:  0,
-			freePageIds: []uint32{},
-			stats:       &TStorageStatistics{},
+			config:        config,
+			device:        device,
+			nextPageId:    0,
+			freeListHead:  InvalidNodeId,
+			freeLinks:     map[uint32]uint32{},
+			stats:         &TStorageStatistics{},
+			layoutVersion: FileLayoutVersion,
+			pool:          makeBufferPool(config.BufferPoolBytes),
+			mapping:       makeMapping(config.MemoryMapped),
+			encryption:    encryption,
+		}
+		if config.CopyOnWrite {
+			storage.shadow = makeShadowPaging(config)
+			storage.nextPageId = metaPagesCount
 		}
 		root, err := storage.AllocateRootNode()
 		if err != nil {
 			return nil, err
 		}
+		if storage.shadow != nil {
+			if err := storage.writeHeader(); err != nil {
+				return nil, err
+			}
+		}
+		// an empty tree is reopened with a valid root page
+		if err := root.Save(); err != nil {
+			return nil, err
+		}
+		// a crash before the first checkpoint would otherwise leave the root page only in the pool
+		if storage.pool != nil {
+			if err := storage.flushPool(); err != nil {
+				return nil, err
+			}
+		}
 		storage.rootNode = root
+		if err := storage.startWal(); err != nil {
+			device.Close()
+			return nil, err
+		}
+		if err := storage.enableCompression(); err != nil {
+			storage.closeDevices()
+			return nil, err
+		}
+		storage.startDurability()
 		return storage, nil
 	}
-	file, err := os.OpenFile(config.FilePath, os.O_RDWR, 0)
+	device, err := openDevice(config)
 	if err != nil {
 		return nil, err
 	}
 	storage := &tOnDiskNodeStorage{
-		config:      config,
-		file:        file,
-		freePageIds: []uint32{},
-		stats:       &TStorageStatistics{},
+		config:       config,
+		device:       device,
+		freeListHead: InvalidNodeId,
+		freeLinks:    map[uint32]uint32{},
+		stats:        &TStorageStatistics{},
+		pool:         makeBufferPool(config.BufferPoolBytes),
+		mapping:      makeMapping(config.MemoryMapped),
+	}
+	if err := storage.recoverWal(); err != nil {
+		storage.closeDevices()
+		return nil, err
 	}
 	if err := storage.readHeader(); err != nil {
+		storage.closeDevices()
+		return nil, err
+	}
+	if err := storage.loadFreeList(); err != nil {
+		storage.closeDevices()
 		return nil, err
 	}
-	if err := storage.detectFreePages(); err != nil {
+	if err := storage.enableCompression(); err != nil {
+		storage.closeDevices()
 		return nil, err
 	}
+	storage.startDurability()
 	return storage, nil
 }
 
 /******************* PRIVATE *******************/
+func checkCopyOnWrite(config TConfig) error {
+	if config.CopyOnWrite && (config.BufferPoolBytes != 0 || config.WriteAheadLog) {
+		return errors.New("copy-on-write can not be combined with the buffer pool or the write-ahead log")
+	}
+	return nil
+}
+
+func (config TConfig) pageHeaderSizeBytes() uint32 {
+	if config.Features&FeatureChecksums != 0 {
+		return pageHeaderSizeBytes + pageChecksumSizeBytes
+	}
+	return pageHeaderSizeBytes
+}
+
+// slots of messages never hold a key prefix
+func (config TConfig) slotSizeBytes() uint32 {
+	if config.Features&FeatureKeyPrefixes != 0 {
+		return slotSizeBytes + keyPrefixSizeBytes
+	}
+	return slotSizeBytes
+}
+
+/*
+Checksum of the header without the checksum itself, the slots, the children and the cells in the order of slots.
+Free space is not covered, so saves still write only changed cells.
+*/
+func pageChecksum(reserved []byte, cells [][]byte) uint32 {
+	checksum := crc32.Update(0, crc32cTable, reserved[:pageHeaderSizeBytes])
+	checksum = crc32.Update(checksum, crc32cTable, reserved[pageHeaderSizeBytes+pageChecksumSizeBytes:])
+	for _, cell := range cells {
+		checksum = crc32.Update(checksum, crc32cTable, cell)
+	}
+	return checksum
+}
+
+func (s *tOnDiskNodeStorage) headerSizeBytes() uint32 {
+	if s.layoutVersion < 3 {
+		return fileHeaderV1SizeBytes
+	}
+	return fileHeaderSizeBytes
+}
+
+func (s *tOnDiskNodeStorage) pageOffset(id uint32) int64 {
+	return int64(s.headerSizeBytes()) + int64(s.config.PageSizeBytes)*int64(id)
+}
+
+/*
+Files of layout version 3 are raised to version 4 before they grow past 4GiB, since readers of version 3
+compute offsets in 32 bits and would access wrong pages. Files with a short header can not be raised.
+*/
+func (s *tOnDiskNodeStorage) addressPages(count uint64) error {
+	if count >= uint64(InvalidNodeId) {
+		return fmt.Errorf("page ids are exhausted, the file can not hold [%v] pages", count)
+	}
+	if s.layoutVersion >= FileLayoutVersion || s.pageOffset(uint32(count)) <= maxShortOffset {
+		return nil
+	}
+	if s.layoutVersion < 3 {
+		return fmt.Errorf("%w: file of layout version [%v] can not grow past 4GiB, it has to be migrated", ErrIncompatible, s.layoutVersion)
+	}
+	s.layoutVersion = FileLayoutVersion
+	return s.writeHeader()
+}
+
+// records features used by the pages, files with a short header keep them only in memory
+func (s *tOnDiskNodeStorage) enableFeatures(features uint32) error {
+	if s.config.Features&features == features {
+		return nil
+	}
+	s.config.Features |= features
+	return s.writeHeader()
+}
+
 func (s *tOnDiskNodeStorage) writeAt(data []byte, offset int64) error {
-	if s.file == nil {
-		return errors.New("already closed")
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.snapshotOf != nil {
+		return ErrReadOnly
+	}
+	if s.wal != nil && s.undo == nil {
+		return s.autocommit(func() error {
+			return s.writeAt(data, offset)
+		})
 	}
-	written, err := s.file.WriteAt(data, offset)
+	if err := s.logChange(data, offset); err != nil {
+		return err
+	}
+	return s.write(data, offset)
+}
+
+// keeps the bytes about to be overwritten for a rollback and logs them along with the new ones
+func (s *tOnDiskNodeStorage) logChange(data []byte, offset int64) error {
+	before, err := s.saveBeforeImage(len(data), offset)
+	if err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return nil
+	}
+	return s.logWrite(offset, before, data)
+}
+
+/*
+Within an operation the file is truncated by the commit, after its commit record, so a rollback finds
+the truncated bytes in place and the log records the sizes only.
+*/
+func (s *tOnDiskNodeStorage) truncate(size int64) error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.snapshotOf != nil {
+		return ErrReadOnly
+	}
+	if s.wal != nil && s.undo == nil {
+		return s.autocommit(func() error {
+			return s.truncate(size)
+		})
+	}
+	deviceSize, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	if size >= deviceSize {
+		return nil
+	}
+	if s.undo == nil {
+		return s.truncateFile(size)
+	}
+	if s.wal != nil {
+		if err := s.logTruncate(size, deviceSize); err != nil {
+			return err
+		}
+	}
+	s.undo.truncateTo = size
+	return nil
+}
+
+// same as writeAt, but is not undone on rollback
+func (s *tOnDiskNodeStorage) write(data []byte, offset int64) error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if err := s.syncWal(); err != nil {
+		return err
+	}
+	if s.writeFault != nil {
+		if err := s.writeFault(data, offset); err != nil {
+			return err
+		}
+	}
+	written, err := s.device.WriteAt(data, offset)
 	if err != nil {
 		return err
 	}
@@ -121,92 +471,203 @@ func (s *tOnDiskNodeStorage) writeAt(data []byte, offset int64) error {
 		return errors.New("written less than expected")
 	}
 	s.stats.WriteCalls += 1
-	s.stats.BytesWritten += uint32(len(data))
+	s.stats.BytesWritten += uint64(len(data))
 	return nil
 }
 
 func (s *tOnDiskNodeStorage) readAt(data []byte, offset int64) error {
 	expectedToRead := len(data)
-	read, err := s.file.ReadAt(data, offset)
+	read, err := s.device.ReadAt(data, offset)
 	if err != nil {
-		return fmt.Errorf("failed to read, error [%v]", err)
+		return fmt.Errorf("failed to read, error [%w]", err)
 	}
 	if read != expectedToRead {
 		return fmt.Errorf("read less than expected, [%v]/[%v]", read, expectedToRead)
 	}
 	s.stats.ReadCalls += 1
-	s.stats.BytesRead += uint32(read)
+	s.stats.BytesRead += uint64(read)
 	return nil
 }
 
+/*
+Offsets read from the page are checked against its bounds, so a damaged page is reported
+as TCorruptedPageError instead of being parsed. With FeatureChecksums the checksum is verified as well.
+*/
 func (s *tOnDiskNodeStorage) makeNodeFromRaw(nodeId uint32, raw []byte) (*tNode, error) {
 	// todo: parse V2
-	node := &tNode{id: nodeId, parent: s}
+	corrupted := func(format string, args ...any) (*tNode, error) {
+		return nil, &TCorruptedPageError{PageId: nodeId, Reason: fmt.Sprintf(format, args...)}
+	}
+	pageSize := uint64(len(raw))
+	headerSize := uint64(s.config.pageHeaderSizeBytes())
+	node := &tNode{id: nodeId, parent: s, generation: s.generation}
 	flags := raw[0]
+	if s.config.Features&FeatureChecksums != 0 && !checkBit(flags, 0) {
+		return corrupted("page is not allocated")
+	}
 	node.isLeaf = checkBit(flags, 1)
-	node.tuples = make([]*tTuple, binary.BigEndian.Uint32(raw[1:]))
-	for i := 0; i < len(node.tuples); i++ {
-		sOffset := binary.BigEndian.Uint32(raw[pageHeaderSizeBytes+8*i:])
-		eOffset := binary.BigEndian.Uint32(raw[pageHeaderSizeBytes+8*i+4:])
-		keyLen := binary.BigEndian.Uint32(raw[sOffset:])
-		key := raw[sOffset+4 : sOffset+4+keyLen]
-		var value []byte
-		if node.isLeaf {
-			value = raw[sOffset+4+keyLen : eOffset]
-		}
-		node.tuples[i] = &tTuple{
-			key:   key,
-			value: value,
-			offsets: &tCellOffsets{
-				Start: sOffset,
-				End:   eOffset,
-			},
+	cellsCount := uint64(binary.BigEndian.Uint32(raw[1:]))
+	slotSize := uint64(s.config.slotSizeBytes())
+	reserved := headerSize + cellsCount*slotSize
+	if !node.isLeaf {
+		reserved += (cellsCount + 1) * 4
+	}
+	if reserved > pageSize {
+		return corrupted("[%v] cells do not fit into the page", cellsCount)
+	}
+	// parses a cell, the first prefixLen bytes precede the key length
+	parseCell := func(slot uint64, prefixLen uint64, withValue bool) (*tTuple, error) {
+		sOffset := uint64(binary.BigEndian.Uint32(raw[slot:]))
+		eOffset := uint64(binary.BigEndian.Uint32(raw[slot+4:]))
+		if sOffset < reserved || eOffset > pageSize || sOffset+prefixLen+4 > eOffset {
+			return nil, &TCorruptedPageError{PageId: nodeId, Reason: fmt.Sprintf("cell [%v, %v) is out of bounds", sOffset, eOffset)}
+		}
+		keyLen := uint64(binary.BigEndian.Uint32(raw[sOffset+prefixLen:]))
+		keyEnd := sOffset + prefixLen + 4 + keyLen
+		if keyEnd > eOffset || (!withValue && keyEnd != eOffset) {
+			return nil, &TCorruptedPageError{PageId: nodeId, Reason: fmt.Sprintf("key of length [%v] does not fit into cell [%v, %v)", keyLen, sOffset, eOffset)}
+		}
+		tuple := &tTuple{
+			key:     raw[sOffset+prefixLen+4 : keyEnd],
+			offsets: &tCellOffsets{Start: uint32(sOffset), End: uint32(eOffset)},
 		}
+		if withValue {
+			tuple.value = raw[keyEnd:eOffset]
+		}
+		if prefixLen != 0 {
+			tuple.kind = raw[sOffset]
+		}
+		return tuple, nil
+	}
+	node.tuples = make([]*tTuple, cellsCount)
+	for i := range node.tuples {
+		slot := headerSize + slotSize*uint64(i)
+		tuple, err := parseCell(slot, 0, node.isLeaf)
+		if err != nil {
+			return nil, err
+		}
+		if slotSize != slotSizeBytes {
+			tuple.prefix = binary.BigEndian.Uint64(raw[slot+slotSizeBytes:])
+		} else {
+			tuple.prefix = keyPrefix(tuple.key)
+		}
+		node.tuples[i] = tuple
 	}
-	node.calculateFreeOffsets()
 	if !node.isLeaf {
 		node.children = make([]uint32, len(node.tuples)+1)
 		for i := 0; i < len(node.tuples)+1; i++ {
-			node.children[i] = binary.BigEndian.Uint32(raw[pageHeaderSizeBytes+8*len(node.tuples)+i*4:])
+			node.children[i] = binary.BigEndian.Uint32(raw[headerSize+slotSize*cellsCount+uint64(i)*4:])
+		}
+	}
+	if !node.isLeaf && checkBit(flags, 2) {
+		messagesStart := reserved
+		if messagesStart+4 > pageSize {
+			return corrupted("messages count does not fit into the page")
+		}
+		messagesCount := uint64(binary.BigEndian.Uint32(raw[messagesStart:]))
+		reserved += 4 + messagesCount*8
+		if reserved > pageSize {
+			return corrupted("[%v] messages do not fit into the page", messagesCount)
+		}
+		node.messages = make([]*tTuple, messagesCount)
+		for i := range node.messages {
+			message, err := parseCell(messagesStart+4+8*uint64(i), 1, true)
+			if err != nil {
+				return nil, err
+			}
+			node.messages[i] = message
 		}
 	}
+	if s.config.Features&FeatureChecksums != 0 {
+		cells := [][]byte{}
+		for _, cell := range node.cells() {
+			cells = append(cells, raw[cell.offsets.Start:cell.offsets.End])
+		}
+		expected := binary.BigEndian.Uint32(raw[pageHeaderSizeBytes:])
+		if actual := pageChecksum(raw[:reserved], cells); actual != expected {
+			return corrupted("checksum [%x] differs from the recorded [%x]", actual, expected)
+		}
+	}
+	node.calculateFreeOffsets()
 	return node, nil
 }
 
 func (s *tOnDiskNodeStorage) makeNode(nodeId uint32, isLeaf bool, children []uint32) INode {
 	// todo: create V2
 	node := &tNode{
-		id:       nodeId,
-		isLeaf:   isLeaf,
-		children: children,
-		parent:   s,
-		tuples:   []*tTuple{},
+		id:         nodeId,
+		isLeaf:     isLeaf,
+		children:   children,
+		parent:     s,
+		tuples:     []*tTuple{},
+		generation: s.generation,
 	}
 	node.calculateFreeOffsets()
 	return node
 }
 
 func (s *tOnDiskNodeStorage) allocateNode(isLeaf bool, children []uint32) (INode, error) {
-	if len(s.freePageIds) == 0 {
-		if err := s.allocateNewBatch(); err != nil {
+	if s.snapshotOf != nil {
+		return nil, ErrReadOnly
+	}
+	if s.shadow != nil {
+		return s.makeNode(s.allocateShadowPage(), isLeaf, children), nil
+	}
+	nodeId, err := s.popFreePage()
+	if err != nil {
+		return nil, err
+	}
+	node := s.makeNode(nodeId, isLeaf, children)
+	if s.pool != nil {
+		if err := s.cacheNode(node.(*tNode), false); err != nil {
 			return nil, err
 		}
 	}
-	nodeId := s.freePageIds[0]
-	s.freePageIds = s.freePageIds[1:]
-	return s.makeNode(nodeId, isLeaf, children), nil
+	return node, nil
 }
 
 func (s *tOnDiskNodeStorage) readHeader() error {
-	header := make([]byte, fileHeaderSizeBytes)
+	header := make([]byte, fileHeaderV1SizeBytes)
 	if err := s.readAt(header, 0); err != nil {
 		return err
 	}
-	s.layoutVersion = binary.BigEndian.Uint32(header[:4])
-	if s.layoutVersion != 1 && s.layoutVersion != 2 {
-		return fmt.Errorf("usupported layout version [%v]", s.layoutVersion)
+	var rootNodeId uint32
+	if binary.BigEndian.Uint32(header) == fileMagic {
+		header = make([]byte, fileHeaderSizeBytes)
+		if err := s.readAt(header, 0); err != nil {
+			return err
+		}
+		if err := s.parseHeader(header); err != nil {
+			return err
+		}
+		rootNodeId = binary.BigEndian.Uint32(header[8:])
+	} else {
+		s.layoutVersion = binary.BigEndian.Uint32(header[:4])
+		if s.layoutVersion != 1 && s.layoutVersion != 2 {
+			return fmt.Errorf("%w: file [%v] is not a tree storage", ErrIncompatible, s.config.FilePath)
+		}
+		if s.config.PageSizeBytes == 0 {
+			return fmt.Errorf("%w: page size is not recorded in the file [%v] of layout version [%v]", ErrIncompatible, s.config.FilePath, s.layoutVersion)
+		}
+		rootNodeId = binary.BigEndian.Uint32(header[4:])
+	}
+	if err := s.openEncryption(header); err != nil {
+		return err
+	}
+	if s.config.Features&FeatureCopyOnWrite == 0 {
+		if s.config.CopyOnWrite {
+			return fmt.Errorf("%w: file [%v] is not written with copy-on-write", ErrIncompatible, s.config.FilePath)
+		}
+	} else {
+		if err := checkCopyOnWrite(s.config); err != nil {
+			return err
+		}
+		s.shadow = makeShadowPaging(s.config)
+		var err error
+		if rootNodeId, err = s.readMeta(); err != nil {
+			return err
+		}
 	}
-	rootNodeId := binary.BigEndian.Uint32(header[4:])
 	var err error
 	s.rootNode, err = s.LoadNode(rootNodeId)
 	if err != nil {
@@ -215,24 +676,74 @@ func (s *tOnDiskNodeStorage) readHeader() error {
 	return nil
 }
 
+// takes the config from the header, the values configured by the caller have to match it
+func (s *tOnDiskNodeStorage) parseHeader(header []byte) error {
+	s.layoutVersion = binary.BigEndian.Uint32(header[4:])
+	if s.layoutVersion != 3 && s.layoutVersion != FileLayoutVersion {
+		return fmt.Errorf("%w: usupported layout version [%v]", ErrIncompatible, s.layoutVersion)
+	}
+	recorded := s.config
+	recorded.PageSizeBytes = binary.BigEndian.Uint32(header[12:])
+	recorded.MaxCellsCount = binary.BigEndian.Uint32(header[16:])
+	recorded.ComparatorId = binary.BigEndian.Uint32(header[20:])
+	recorded.Features = binary.BigEndian.Uint32(header[24:])
+	recorded.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(header[28:])))
+	recorded.CopyOnWrite = s.config.CopyOnWrite || recorded.Features&FeatureCopyOnWrite != 0
+	s.freeListHead = binary.BigEndian.Uint32(header[36:])
+	if recorded.PageSizeBytes == 0 {
+		return fmt.Errorf("%w: zero page size in the header", ErrCorrupted)
+	}
+	mismatches := []struct {
+		name               string
+		recorded, expected uint32
+	}{
+		{"page size", recorded.PageSizeBytes, s.config.PageSizeBytes},
+		{"max cells count", recorded.MaxCellsCount, s.config.MaxCellsCount},
+		{"comparator id", recorded.ComparatorId, s.config.ComparatorId},
+	}
+	for _, m := range mismatches {
+		if m.expected != 0 && m.expected != m.recorded {
+			return fmt.Errorf("%w: %v of the file [%v] differs from the configured [%v]", ErrIncompatible, m.name, m.recorded, m.expected)
+		}
+	}
+	if unknown := recorded.Features &^ knownFeatures; unknown != 0 {
+		return fmt.Errorf("%w: unknown feature flags [%b]", ErrIncompatible, unknown)
+	}
+	s.config = recorded
+	return nil
+}
+
+// an operation writes the header once, with its commit
 func (s *tOnDiskNodeStorage) writeHeader() error {
-	buf := []byte{}
-	buf = binary.BigEndian.AppendUint32(buf, FileLayoutVersion)
-	buf = binary.BigEndian.AppendUint32(buf, s.rootNode.Id())
-	return s.writeAt(buf, 0)
+	if s.deferHeader() {
+		return nil
+	}
+	return s.writeAt(s.encodeHeader(), 0)
 }
 
-func (s *tOnDiskNodeStorage) allocateNewBatch() error {
-	batchSize := 100
-	pages := make([]byte, int(s.config.PageSizeBytes)*batchSize)
-	if err := s.writeAt(pages, int64(fileHeaderSizeBytes+s.nextPageId)); err != nil {
-		return err
+func (s *tOnDiskNodeStorage) encodeHeader() []byte {
+	if s.layoutVersion < 3 {
+		buf := []byte{}
+		buf = binary.BigEndian.AppendUint32(buf, s.layoutVersion)
+		buf = binary.BigEndian.AppendUint32(buf, s.rootNode.Id())
+		return buf
 	}
-	for i := s.nextPageId; i < s.nextPageId+uint32(batchSize); i++ {
-		s.freePageIds = append(s.freePageIds, i)
+	buf := make([]byte, 0, fileHeaderSizeBytes)
+	buf = binary.BigEndian.AppendUint32(buf, fileMagic)
+	buf = binary.BigEndian.AppendUint32(buf, s.layoutVersion)
+	buf = binary.BigEndian.AppendUint32(buf, s.rootNode.Id())
+	buf = binary.BigEndian.AppendUint32(buf, s.config.PageSizeBytes)
+	buf = binary.BigEndian.AppendUint32(buf, s.config.MaxCellsCount)
+	buf = binary.BigEndian.AppendUint32(buf, s.config.ComparatorId)
+	buf = binary.BigEndian.AppendUint32(buf, s.config.Features)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(s.config.CreatedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, s.freeListHead)
+	if s.encryption != nil {
+		buf = append(buf, s.encryption.checkValue...)
 	}
-	s.nextPageId += uint32(batchSize)
-	return nil
+	buf = append(buf, make([]byte, fileHeaderSizeBytes-len(buf))...)
+	// reserved write counters are only written by nextCounter
+	return buf[:reservedCountersOffset]
 }
 
 func checkBit(flags byte, idx int) bool {
@@ -240,24 +751,3 @@ func checkBit(flags byte, idx int) bool {
 	flags = flags >> 7
 	return flags == 1
 }
-
-func (s *tOnDiskNodeStorage) detectFreePages() error {
-	info, err := s.file.Stat()
-	if err != nil {
-		return err
-	}
-	if (info.Size()-fileHeaderSizeBytes)%int64(s.config.PageSizeBytes) != 0 {
-		return fmt.Errorf("invalid size [%v] of the file [%v]", info.Size(), s.file.Name())
-	}
-	s.nextPageId = uint32((info.Size() - fileHeaderSizeBytes) / int64(s.config.PageSizeBytes))
-	pageFlags := make([]byte, 1)
-	for pageId := uint32(0); pageId < s.nextPageId; pageId++ {
-		if err := s.readAt(pageFlags, int64(s.config.PageSizeBytes*pageId+fileHeaderSizeBytes)); err != nil {
-			return err
-		}
-		if !checkBit(pageFlags[0], 0) {
-			s.freePageIds = append(s.freePageIds, pageId)
-		}
-	}
-	return nil
-}
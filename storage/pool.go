@@ -0,0 +1,249 @@
+package storage
+
+import "container/list"
+
+/******************* PUBLIC *******************/
+/*
+Keeps the page of a node in the buffer pool until UnpinNode, so hot nodes held across operations
+are not evicted and reloaded. Pins of pages freed, relocated by Compact or dropped by a rollback
+are released with them. Without the buffer pool every load reads the page, so pins do nothing.
+*/
+func (s *tOnDiskNodeStorage) PinNode(id uint32) error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.pool == nil {
+		return nil
+	}
+	if _, err := s.LoadNode(id); err != nil {
+		return err
+	}
+	if entry, ok := s.pool.entries[id]; ok {
+		s.pin(entry)
+	}
+	return nil
+}
+
+// releases a pin of PinNode, the page may be evicted once it has none
+func (s *tOnDiskNodeStorage) UnpinNode(id uint32) error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.pool == nil {
+		return nil
+	}
+	entry, ok := s.pool.entries[id]
+	if !ok {
+		return nil
+	}
+	// the pin of the operation in progress is kept until it ends
+	held := 0
+	if entry.touched {
+		held = 1
+	}
+	if entry.pins > held {
+		s.unpin(entry)
+	}
+	return s.evict()
+}
+
+/******************* PRIVATE *******************/
+/*
+Buffer pool caches decoded nodes up to TConfig.BufferPoolBytes and evicts the least recently used ones.
+Saved nodes are only marked dirty and written back once evicted or when the storage is closed.
+Nodes touched by an operation are pinned until it ends, so the operation never loses a node it holds,
+and dirty nodes keep their image from before the operation to be restored on rollback.
+The root node is never evicted, pinned nodes may exceed the budget. Callers may pin nodes with PinNode as well.
+*/
+func makeBufferPool(budgetBytes uint32) *tBufferPool {
+	if budgetBytes == 0 {
+		return nil
+	}
+	return &tBufferPool{budgetBytes: budgetBytes, entries: make(map[uint32]*tPoolEntry), lru: list.New()}
+}
+
+// returns nil on a miss
+func (s *tOnDiskNodeStorage) cachedNode(id uint32) *tNode {
+	entry, ok := s.pool.entries[id]
+	if !ok {
+		s.stats.CacheMisses += 1
+		return nil
+	}
+	s.stats.CacheHits += 1
+	s.pool.lru.MoveToFront(entry.element)
+	s.touch(entry)
+	return entry.node
+}
+
+// adds or replaces the node of a page, evicts other pages once the pool is over its budget
+func (s *tOnDiskNodeStorage) cacheNode(node *tNode, dirty bool) error {
+	entry, ok := s.pool.entries[node.id]
+	if ok {
+		entry.node = node
+		entry.dirty = entry.dirty || dirty
+		s.pool.lru.MoveToFront(entry.element)
+		s.touch(entry)
+		return nil
+	}
+	entry = &tPoolEntry{node: node, dirty: dirty}
+	entry.element = s.pool.lru.PushFront(entry)
+	s.pool.entries[node.id] = entry
+	s.touch(entry)
+	return s.evict()
+}
+
+// with the write-ahead log, a page saved outside of an operation is logged as an operation of its own
+func (s *tOnDiskNodeStorage) markDirty(node *tNode) error {
+	if s.wal != nil && s.undo == nil {
+		return s.autocommit(func() error {
+			return s.cacheNode(node, true)
+		})
+	}
+	return s.cacheNode(node, true)
+}
+
+func (s *tOnDiskNodeStorage) touchNode(node *tNode) {
+	if entry, ok := s.pool.entries[node.id]; ok && entry.node == node {
+		s.touch(entry)
+	}
+}
+
+// pins the entry until the operation in progress ends
+func (s *tOnDiskNodeStorage) touch(entry *tPoolEntry) {
+	if s.undo == nil || entry.touched {
+		return
+	}
+	if entry.dirty {
+		entry.image = entry.node.encodePage()
+	}
+	entry.touched = true
+	s.pin(entry)
+	s.pool.touched = append(s.pool.touched, entry)
+}
+
+func (s *tOnDiskNodeStorage) pin(entry *tPoolEntry) {
+	entry.pins += 1
+}
+
+func (s *tOnDiskNodeStorage) unpin(entry *tPoolEntry) {
+	entry.pins -= 1
+}
+
+func (s *tOnDiskNodeStorage) evict() error {
+	pageSize := s.config.PageSizeBytes
+	element := s.pool.lru.Back()
+	for uint64(len(s.pool.entries))*uint64(pageSize) > uint64(s.pool.budgetBytes) && element != nil {
+		entry := element.Value.(*tPoolEntry)
+		element = element.Prev()
+		if entry.pins > 0 || (s.rootNode != nil && entry.node.id == s.rootNode.Id()) {
+			continue
+		}
+		if entry.dirty {
+			if err := s.writeBack(entry); err != nil {
+				return err
+			}
+		}
+		s.drop(entry)
+		s.stats.Evictions += 1
+	}
+	return nil
+}
+
+/*
+Dirty pages not touched by the operation in progress hold committed data, so writing them back
+is not undone on rollback.
+*/
+func (s *tOnDiskNodeStorage) writeBack(entry *tPoolEntry) error {
+	if err := s.writePage(entry.node.id, entry.node.encodePage(), s.write); err != nil {
+		return err
+	}
+	entry.dirty = false
+	return nil
+}
+
+/*
+Drops the page of a freed node. The page is left on disk with its committed content first,
+so a rollback of the operation which freed it can load the page again.
+*/
+func (s *tOnDiskNodeStorage) forgetPage(id uint32) error {
+	entry, ok := s.pool.entries[id]
+	if !ok {
+		return nil
+	}
+	if entry.touched && entry.image != nil {
+		if err := s.writePage(id, entry.image, s.write); err != nil {
+			return err
+		}
+	} else if !entry.touched && entry.dirty {
+		if err := s.writeBack(entry); err != nil {
+			return err
+		}
+	}
+	s.drop(entry)
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) drop(entry *tPoolEntry) {
+	s.pool.lru.Remove(entry.element)
+	delete(s.pool.entries, entry.node.id)
+}
+
+// writes back all dirty pages in the order of their ids, consecutive pages in single writes
+func (s *tOnDiskNodeStorage) flushPool() error {
+	dirty := []*tPoolEntry{}
+	for _, entry := range s.pool.entries {
+		if entry.dirty {
+			dirty = append(dirty, entry)
+		}
+	}
+	nodes := make([]*tNode, len(dirty))
+	for i, entry := range dirty {
+		nodes[i] = entry.node
+	}
+	if err := s.writePages(nodes, s.write); err != nil {
+		return err
+	}
+	for _, entry := range dirty {
+		entry.dirty = false
+	}
+	if !s.pool.headerDirty {
+		return nil
+	}
+	if err := s.write(s.encodeHeader(), 0); err != nil {
+		return err
+	}
+	s.pool.headerDirty = false
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) commitPool() {
+	for _, entry := range s.pool.touched {
+		entry.touched = false
+		entry.image = nil
+		s.unpin(entry)
+	}
+	s.pool.touched = nil
+}
+
+// restores pages which were dirty before the operation and drops all other touched pages
+func (s *tOnDiskNodeStorage) rollbackPool() error {
+	touched := s.pool.touched
+	s.pool.touched = nil
+	for _, entry := range touched {
+		entry.touched = false
+		s.unpin(entry)
+		if entry.image == nil {
+			if s.pool.entries[entry.node.id] == entry {
+				s.drop(entry)
+			}
+			continue
+		}
+		node, err := s.makeNodeFromRaw(entry.node.id, entry.image)
+		if err != nil {
+			return err
+		}
+		entry.node = node
+		entry.image = nil
+	}
+	return nil
+}
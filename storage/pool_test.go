@@ -0,0 +1,99 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
+)
+
+func TestBufferPoolHits(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, BufferPoolBytes: 1 << 20}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTree(strg, 0)
+	keys, values := manyKeys(1000)
+	util.ShuffleSliceBytes(keys)
+	for i, key := range keys {
+		values[i] = key
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	before := *strg.Statistics()
+	require.Zero(t, before.ReadCalls)
+	require.Zero(t, before.Evictions)
+	checkStored(t, tree, keys, values)
+	after := *strg.Statistics()
+	require.Equal(t, before.ReadCalls, after.ReadCalls)
+	require.Equal(t, before.WriteCalls, after.WriteCalls)
+	require.Equal(t, before.CacheMisses, after.CacheMisses)
+	require.Greater(t, after.CacheHits, before.CacheHits)
+}
+
+func TestBufferPoolWriteBack(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: filePath, BufferPoolBytes: 256 * 4}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTree(strg, 0)
+	keys, values := manyKeys(1000)
+	util.ShuffleSliceBytes(keys)
+	for i, key := range keys {
+		values[i] = key
+		require.Empty(t, tree.Put(key, values[i]))
+	}
+	checkStored(t, tree, keys, values)
+	stats := strg.Statistics()
+	require.NotZero(t, stats.Evictions)
+	require.NotZero(t, stats.CacheMisses)
+	require.NotZero(t, stats.CacheHits)
+	require.Empty(t, strg.Close())
+
+	config.BufferPoolBytes = 0
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, btree.MakePagedBTree(strg, 0), keys, values)
+}
+
+// a pinned page stays in the pool while other pages are evicted
+func TestBufferPoolPinNode(t *testing.T) {
+	filePath := "./" + util.TimeBasedFileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: filePath, BufferPoolBytes: 256 * 4}
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTree(strg, 0)
+	keys, _ := manyKeys(1000)
+	for _, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+	}
+	node := strg.RootNode()
+	for !node.IsLeaf() {
+		node, err = strg.LoadNode(node.Child(0))
+		require.Empty(t, err)
+	}
+	leftmost := node.Id()
+	loadMisses := func() uint64 {
+		checkStored(t, tree, keys, keys)
+		before := strg.Statistics().CacheMisses
+		_, err := strg.LoadNode(leftmost)
+		require.Empty(t, err)
+		return strg.Statistics().CacheMisses - before
+	}
+
+	require.Empty(t, strg.PinNode(leftmost))
+	require.Equal(t, uint64(0), loadMisses())
+	require.Empty(t, strg.UnpinNode(leftmost))
+	require.Equal(t, uint64(1), loadMisses())
+	// unpinning a page without pins does nothing
+	require.Empty(t, strg.UnpinNode(leftmost))
+	checkStored(t, tree, keys, keys)
+}
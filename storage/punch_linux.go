@@ -0,0 +1,27 @@
+//go:build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// block size of the file system holding the file, 0 if unknown
+func fileBlockSize(file *os.File) int64 {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &stat); err != nil {
+		return 0
+	}
+	return int64(stat.Blksize)
+}
+
+// fails on file systems without hole punching, which keep the blocks
+func punchHole(file *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+}
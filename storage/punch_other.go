@@ -0,0 +1,18 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// block size of the file system holding the file, 0 if unknown
+func fileBlockSize(file *os.File) int64 {
+	return 0
+}
+
+// compressed pages keep their blocks
+func punchHole(file *os.File, offset, length int64) error {
+	return errors.New("hole punching is not supported")
+}
@@ -0,0 +1,550 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+/*
+Copy-on-write shadow paging, enabled by TConfig.CopyOnWrite. Pages of the last commit are never overwritten:
+nodes saved by an operation are kept in memory until the commit, which writes them to pages taken since
+the last commit. A node of the committed tree moves to a new page, so its parent is changed and moves as well,
+up to the root. Once the pages are synced the commit switches the root by writing the older one of the two
+meta pages at the start of the file, a crash at any point leaves the other one pointing to a complete tree.
+Replaced pages are reused once no snapshot reads them. Every commit writes the pages it leaves free into
+a chain of free list pages taken from the free ones, the meta page points to its head, so opening a file reads
+the chain. Files written before the chain and damaged chains are rebuilt from the pages reachable from the root.
+*/
+
+/******************* PUBLIC *******************/
+/*
+Returns a read-only view of the tree as of the last commit, which later operations do not change.
+Pages read by the view are not reused until it is closed, views have to be closed before the storage.
+Snapshots may be taken and read concurrently with the operations of the storage.
+*/
+func (s *tOnDiskNodeStorage) Snapshot() (INodeStorage, error) {
+	if s.device == nil {
+		return nil, ErrClosed
+	}
+	if s.snapshotOf != nil {
+		return nil, ErrReadOnly
+	}
+	if s.shadow == nil {
+		return nil, errors.New("snapshots require copy-on-write")
+	}
+	s.shadow.mutex.Lock()
+	txnId, rootNodeId, config := s.shadow.txnId, s.shadow.rootNodeId, s.shadow.config
+	s.shadow.snapshots[txnId] += 1
+	s.shadow.mutex.Unlock()
+	view := &tOnDiskNodeStorage{
+		config:        config,
+		device:        s.device,
+		freeListHead:  InvalidNodeId,
+		stats:         &TStorageStatistics{},
+		layoutVersion: s.layoutVersion,
+		mapping:       makeMapping(config.MemoryMapped),
+		encryption:    s.encryption, // only used to decrypt
+		snapshotOf:    s,
+		snapshotTxnId: txnId,
+	}
+	root, err := view.LoadNode(rootNodeId)
+	if err != nil {
+		view.Close()
+		return nil, err
+	}
+	view.rootNode = root
+	return view, nil
+}
+
+/******************* PRIVATE *******************/
+const metaPagesCount uint32 = 2
+const metaPageV1SizeBytes = 21        // meta pages written before the free list have no first free list page
+const freeListPageHeaderSizeBytes = 9 // flags [1] + next free list page [4] + ids count [4], followed by ids [4] and crc32c [4]
+
+func makeShadowPaging(config TConfig) *tShadowPaging {
+	return &tShadowPaging{
+		uncommitted: map[uint32]bool{},
+		dirty:       map[uint32]*tNode{},
+		config:      config,
+		snapshots:   map[uint64]int{},
+	}
+}
+
+// the device is shared with the storage, which closes it
+func (s *tOnDiskNodeStorage) closeSnapshot() error {
+	shadow := s.snapshotOf.shadow
+	shadow.mutex.Lock()
+	shadow.snapshots[s.snapshotTxnId] -= 1
+	if shadow.snapshots[s.snapshotTxnId] == 0 {
+		delete(shadow.snapshots, s.snapshotTxnId)
+	}
+	shadow.mutex.Unlock()
+	var err error
+	if s.mapping != nil {
+		err = s.closeMapping()
+	}
+	s.device = nil
+	return err
+}
+
+// a node saved outside of an operation is committed as an operation of its own
+func (s *tOnDiskNodeStorage) saveShadowNode(node *tNode) error {
+	if s.undo == nil {
+		return s.autocommit(func() error {
+			return s.saveShadowNode(node)
+		})
+	}
+	s.shadow.dirty[node.id] = node
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) freeShadowPage(id uint32) error {
+	if id < metaPagesCount {
+		return fmt.Errorf("page [%v] is a meta page", id)
+	}
+	if s.undo == nil {
+		return s.autocommit(func() error {
+			return s.freeShadowPage(id)
+		})
+	}
+	delete(s.shadow.dirty, id)
+	s.shadow.freed = append(s.shadow.freed, id)
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) allocateShadowPage() uint32 {
+	shadow := s.shadow
+	var id uint32
+	if len(shadow.free) > 0 {
+		id = shadow.free[len(shadow.free)-1]
+		shadow.free = shadow.free[:len(shadow.free)-1]
+	} else {
+		id = s.nextPageId
+		s.nextPageId += 1
+	}
+	shadow.uncommitted[id] = true
+	return id
+}
+
+/*
+Writes the nodes saved by the operation and their moved ancestors, syncs them and switches the root.
+A failure leaves the operation in progress and the last commit intact, but nodes held by the operation
+may be moved already, so it has to be rolled back.
+*/
+func (s *tOnDiskNodeStorage) commitShadow() error {
+	shadow := s.shadow
+	root := s.rootNode.(*tNode)
+	if saved, ok := shadow.dirty[root.id]; ok {
+		root = saved
+	}
+	if len(shadow.dirty) == 0 && len(shadow.freed) == 0 && root.id == shadow.rootNodeId {
+		s.resetShadowOperation()
+		return nil
+	}
+	written, replaced, err := s.relocateShadowNodes(root)
+	if err != nil {
+		return err
+	}
+	abandoned := s.abandonedShadowPages(written)
+	listPages, list := s.encodeShadowFreeList(append(replaced, abandoned...))
+	if err := s.addressPages(uint64(s.nextPageId)); err != nil {
+		return err
+	}
+	if err := s.writePages(written, s.write); err != nil {
+		return err
+	}
+	for i, id := range listPages {
+		if err := s.write(list[i], s.pageOffset(id)); err != nil {
+			return err
+		}
+	}
+	// pages taken but never written still belong to the file
+	size, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	if size < s.pageOffset(s.nextPageId) {
+		if err := s.truncateFile(s.pageOffset(s.nextPageId)); err != nil {
+			return err
+		}
+	}
+	if err := s.device.Sync(); err != nil {
+		return err
+	}
+	txnId := shadow.txnId + 1
+	listHead := InvalidNodeId
+	if len(listPages) > 0 {
+		listHead = listPages[0]
+	}
+	if err := s.writeMeta(txnId, root.id, listHead); err != nil {
+		return err
+	}
+	// the previous list is only read on open, so its pages are free once the meta page is switched
+	shadow.free = append(shadow.free, abandoned...)
+	shadow.free = append(shadow.free, shadow.listPages...)
+	shadow.listPages = listPages
+	for _, id := range shadow.freed {
+		if shadow.uncommitted[id] {
+			shadow.free = append(shadow.free, id)
+		} else {
+			replaced = append(replaced, id)
+		}
+	}
+	shadow.mutex.Lock()
+	shadow.txnId = txnId
+	shadow.rootNodeId = root.id
+	shadow.config = s.config
+	shadow.mutex.Unlock()
+	for _, id := range replaced {
+		shadow.released = append(shadow.released, tReleasedPage{id: id, txnId: txnId})
+	}
+	s.reclaimShadowPages()
+	s.rootNode = root
+	s.resetShadowOperation()
+	return nil
+}
+
+/*
+Moves saved nodes of committed pages to new pages, changing the children of their parents, which are
+saved and moved in turn. Parents are looked up among the nodes loaded by the operation.
+Returns the nodes to write in the order of pages and the replaced pages.
+*/
+func (s *tOnDiskNodeStorage) relocateShadowNodes(root *tNode) ([]*tNode, []uint32, error) {
+	shadow := s.shadow
+	freed := map[uint32]bool{}
+	for _, id := range shadow.freed {
+		freed[id] = true
+	}
+	// the latest node of every page, the operation may hold stale copies
+	current := map[uint32]*tNode{root.id: root}
+	for _, node := range shadow.loaded {
+		if _, ok := current[node.id]; !ok && !freed[node.id] {
+			current[node.id] = node
+		}
+	}
+	for id, node := range shadow.dirty {
+		current[id] = node
+	}
+	parents := map[uint32]*tNode{}
+	for _, node := range current {
+		for _, child := range node.children {
+			if child != InvalidNodeId {
+				parents[child] = node
+			}
+		}
+	}
+	queued := map[*tNode]bool{}
+	pending := []*tNode{}
+	for id, node := range shadow.dirty {
+		queued[node] = true
+		if !shadow.uncommitted[id] {
+			pending = append(pending, node)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].id < pending[j].id })
+	replaced := []uint32{}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+		oldId := node.id
+		// the replaced page is reused later, while the node may still be held
+		node.detach()
+		node.id = s.allocateShadowPage()
+		replaced = append(replaced, oldId)
+		if node == root {
+			continue
+		}
+		parent, ok := parents[oldId]
+		if !ok {
+			return nil, nil, fmt.Errorf("parent of page [%v] is not loaded by the operation", oldId)
+		}
+		for i, child := range parent.children {
+			if child == oldId {
+				parent.children[i] = node.id
+			}
+		}
+		if !queued[parent] {
+			queued[parent] = true
+			if !shadow.uncommitted[parent.id] {
+				pending = append(pending, parent)
+			}
+		}
+	}
+	written := make([]*tNode, 0, len(queued))
+	for node := range queued {
+		written = append(written, node)
+	}
+	sort.Slice(written, func(i, j int) bool { return written[i].id < written[j].id })
+	return written, replaced, nil
+}
+
+// pages taken by the operation, which were neither saved nor freed
+func (s *tOnDiskNodeStorage) abandonedShadowPages(written []*tNode) []uint32 {
+	used := map[uint32]bool{}
+	for _, node := range written {
+		used[node.id] = true
+	}
+	for _, id := range s.shadow.freed {
+		used[id] = true
+	}
+	abandoned := []uint32{}
+	for id := range s.shadow.uncommitted {
+		if !used[id] {
+			abandoned = append(abandoned, id)
+		}
+	}
+	return abandoned
+}
+
+/*
+Takes pages for the list of the pages free after the commit: the free and released ones, the ones replaced
+and freed by the operation and the pages of the previous list. Pages taken from the free ones are not listed.
+Returns the pages in the order of the chain and their contents.
+*/
+func (s *tOnDiskNodeStorage) encodeShadowFreeList(replaced []uint32) ([]uint32, [][]byte) {
+	shadow := s.shadow
+	perPage := (int(s.config.PageSizeBytes) - freeListPageHeaderSizeBytes - 4) / 4
+	count := len(shadow.free) + len(shadow.released) + len(replaced) + len(shadow.freed) + len(shadow.listPages)
+	listPages := []uint32{}
+	for len(listPages)*perPage < count {
+		if len(shadow.free) > 0 {
+			count--
+		}
+		listPages = append(listPages, s.allocateShadowPage())
+	}
+	ids := make([]uint32, 0, count)
+	ids = append(ids, shadow.free...)
+	for _, page := range shadow.released {
+		ids = append(ids, page.id)
+	}
+	ids = append(ids, replaced...)
+	ids = append(ids, shadow.freed...)
+	ids = append(ids, shadow.listPages...)
+	list := make([][]byte, len(listPages))
+	for i := range listPages {
+		next := InvalidNodeId
+		if i+1 < len(listPages) {
+			next = listPages[i+1]
+		}
+		end := (i + 1) * perPage
+		if end > len(ids) {
+			end = len(ids)
+		}
+		list[i] = encodeFreeListPage(next, ids[i*perPage:end])
+	}
+	return listPages, list
+}
+
+func encodeFreeListPage(next uint32, ids []uint32) []byte {
+	page := make([]byte, 0, freeListPageHeaderSizeBytes+4*len(ids)+4)
+	page = append(page, setBit(setBit(0, 0), 4))
+	page = binary.BigEndian.AppendUint32(page, next)
+	page = binary.BigEndian.AppendUint32(page, uint32(len(ids)))
+	for _, id := range ids {
+		page = binary.BigEndian.AppendUint32(page, id)
+	}
+	return binary.BigEndian.AppendUint32(page, crc32.Checksum(page, crc32cTable))
+}
+
+// returns the free pages and the pages of the chain, a damaged chain is reported as ErrCorrupted
+func (s *tOnDiskNodeStorage) readShadowFreeList(head uint32) ([]uint32, []uint32, error) {
+	perPage := (s.config.PageSizeBytes - freeListPageHeaderSizeBytes - 4) / 4
+	seen := map[uint32]bool{}
+	check := func(id uint32) error {
+		if id < metaPagesCount || id >= s.nextPageId || seen[id] {
+			return fmt.Errorf("%w: free page [%v] is invalid or listed twice", ErrCorrupted, id)
+		}
+		seen[id] = true
+		return nil
+	}
+	free, listPages := []uint32{}, []uint32{}
+	raw := make([]byte, s.config.PageSizeBytes)
+	for id := head; id != InvalidNodeId; {
+		if err := check(id); err != nil {
+			return nil, nil, err
+		}
+		if err := s.readAt(raw, s.pageOffset(id)); err != nil {
+			return nil, nil, err
+		}
+		count := binary.BigEndian.Uint32(raw[5:])
+		if !checkBit(raw[0], 4) || count > perPage {
+			return nil, nil, &TCorruptedPageError{PageId: id, Reason: "page is not a free list page"}
+		}
+		end := freeListPageHeaderSizeBytes + 4*count
+		if crc32.Checksum(raw[:end], crc32cTable) != binary.BigEndian.Uint32(raw[end:]) {
+			return nil, nil, &TCorruptedPageError{PageId: id, Reason: "checksum of the free list page differs"}
+		}
+		listPages = append(listPages, id)
+		for i := uint32(0); i < count; i++ {
+			free = append(free, binary.BigEndian.Uint32(raw[freeListPageHeaderSizeBytes+4*i:]))
+		}
+		id = binary.BigEndian.Uint32(raw[1:])
+	}
+	for _, id := range free {
+		if err := check(id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return free, listPages, nil
+}
+
+// pages replaced by the commit of txnId were read by the earlier commits only
+func (s *tOnDiskNodeStorage) reclaimShadowPages() {
+	shadow := s.shadow
+	shadow.mutex.Lock()
+	oldest := shadow.txnId
+	for txnId := range shadow.snapshots {
+		if txnId < oldest {
+			oldest = txnId
+		}
+	}
+	shadow.mutex.Unlock()
+	kept := shadow.released[:0]
+	for _, page := range shadow.released {
+		if page.txnId <= oldest {
+			shadow.free = append(shadow.free, page.id)
+		} else {
+			kept = append(kept, page)
+		}
+	}
+	shadow.released = kept
+}
+
+// pages taken by the operation are free again, the pages past the restored end of the file are dropped
+func (s *tOnDiskNodeStorage) rollbackShadow(undo *tUndoLog) {
+	taken := []uint32{}
+	for id := range s.shadow.uncommitted {
+		if id < undo.nextPageId {
+			taken = append(taken, id)
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool { return taken[i] > taken[j] })
+	s.shadow.free = append(s.shadow.free, taken...)
+	s.resetShadowOperation()
+}
+
+func (s *tOnDiskNodeStorage) resetShadowOperation() {
+	s.shadow.uncommitted = map[uint32]bool{}
+	s.shadow.dirty = map[uint32]*tNode{}
+	s.shadow.loaded = nil
+	s.shadow.freed = nil
+}
+
+// the flag of bit 4 marks the meta pages recording the first free list page
+func encodeMetaPage(txnId uint64, rootNodeId, pageCount, listHead uint32) []byte {
+	page := make([]byte, 0, metaPageSizeBytes)
+	page = append(page, setBit(setBit(setBit(0, 0), 3), 4))
+	page = binary.BigEndian.AppendUint64(page, txnId)
+	page = binary.BigEndian.AppendUint32(page, rootNodeId)
+	page = binary.BigEndian.AppendUint32(page, pageCount)
+	page = binary.BigEndian.AppendUint32(page, listHead)
+	return binary.BigEndian.AppendUint32(page, crc32.Checksum(page, crc32cTable))
+}
+
+// a failed write is cleared, so the meta page of the previous commit is chosen on open
+func (s *tOnDiskNodeStorage) writeMeta(txnId uint64, rootNodeId, listHead uint32) error {
+	offset := s.pageOffset(uint32(txnId % uint64(metaPagesCount)))
+	err := s.write(encodeMetaPage(txnId, rootNodeId, s.nextPageId, listHead), offset)
+	if err == nil {
+		err = s.device.Sync()
+	}
+	if err != nil {
+		if clearErr := s.write(make([]byte, metaPageSizeBytes), offset); clearErr != nil {
+			return fmt.Errorf("%w, failed to clear the meta page with error [%v]", err, clearErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// takes the valid meta page of the latest commit, returns the id of its root
+func (s *tOnDiskNodeStorage) readMeta() (uint32, error) {
+	found := false
+	var rootNodeId uint32
+	raw := make([]byte, metaPageSizeBytes)
+	for id := uint32(0); id < metaPagesCount; id++ {
+		if err := s.readAt(raw, s.pageOffset(id)); err != nil {
+			return InvalidNodeId, err
+		}
+		listed := checkBit(raw[0], 4)
+		payload := raw[:metaPageV1SizeBytes-4]
+		if listed {
+			payload = raw[:metaPageSizeBytes-4]
+		}
+		if !checkBit(raw[0], 3) || crc32.Checksum(payload, crc32cTable) != binary.BigEndian.Uint32(raw[len(payload):]) {
+			continue
+		}
+		txnId := binary.BigEndian.Uint64(raw[1:])
+		if found && txnId <= s.shadow.txnId {
+			continue
+		}
+		found = true
+		s.shadow.txnId = txnId
+		rootNodeId = binary.BigEndian.Uint32(raw[9:])
+		s.nextPageId = binary.BigEndian.Uint32(raw[13:])
+		s.shadow.listed = listed
+		if listed {
+			s.shadow.listHead = binary.BigEndian.Uint32(raw[17:])
+		}
+	}
+	if !found {
+		return InvalidNodeId, fmt.Errorf("%w: no valid meta page in the file [%v]", ErrCorrupted, s.config.FilePath)
+	}
+	if rootNodeId < metaPagesCount || rootNodeId >= s.nextPageId {
+		return InvalidNodeId, fmt.Errorf("%w: root page [%v] does not exist", ErrCorrupted, rootNodeId)
+	}
+	s.shadow.rootNodeId = rootNodeId
+	return rootNodeId, nil
+}
+
+/*
+Pages past the page count were written by an interrupted commit. Free pages are read from the list of the commit,
+without a valid list the pages unreachable from the root are free.
+*/
+func (s *tOnDiskNodeStorage) loadShadowPages() error {
+	deviceSize, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	size := s.pageOffset(s.nextPageId)
+	if deviceSize < size {
+		return fmt.Errorf("%w: invalid size [%v] of the file [%v]", ErrCorrupted, deviceSize, s.config.FilePath)
+	}
+	if deviceSize > size {
+		if err := s.truncateFile(size); err != nil {
+			return err
+		}
+	}
+	s.shadow.config = s.config
+	if s.shadow.listed {
+		free, listPages, err := s.readShadowFreeList(s.shadow.listHead)
+		if err == nil {
+			s.shadow.free = free
+			s.shadow.listPages = listPages
+			return nil
+		}
+		if !errors.Is(err, ErrCorrupted) {
+			return err
+		}
+	}
+	return s.rebuildShadowPages()
+}
+
+// the next commit writes the list again
+func (s *tOnDiskNodeStorage) rebuildShadowPages() error {
+	live, err := s.reachablePages()
+	if err != nil {
+		return err
+	}
+	s.shadow.free = nil
+	s.shadow.listPages = nil
+	for id := s.nextPageId; id > metaPagesCount; id-- {
+		if !s.isLive(live, id-1) {
+			s.shadow.free = append(s.shadow.free, id-1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+)
+
+func TestCrashRecoveryCopyOnWrite(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + fileName(), MaxCellsCount: 5, CopyOnWrite: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTree(strg, 5)
+	})
+}
+
+func TestCrashRecoveryCopyOnWriteBuffered(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + fileName(), CopyOnWrite: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakeBufferedBTree(strg)
+	})
+}
+
+func TestCopyOnWriteConfig(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), CopyOnWrite: true}
+	defer os.Remove(config.FilePath)
+	_, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 256, FilePath: config.FilePath, CopyOnWrite: true, WriteAheadLog: true})
+	require.Error(t, err)
+	makeManyPages(t, config)
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	require.Equal(t, storage.FeatureChecksums|storage.FeatureCopyOnWrite|storage.FeatureKeyPrefixes, binary.BigEndian.Uint32(data[24:]))
+
+	_, err = storage.MakeNodeStorage(storage.TConfig{FilePath: config.FilePath, BufferPoolBytes: 256 * 8})
+	require.Error(t, err)
+	strg, err := storage.MakeNodeStorage(storage.TConfig{FilePath: config.FilePath})
+	require.Empty(t, err)
+	defer strg.Close()
+	require.True(t, strg.Config().CopyOnWrite)
+	require.Nil(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{AppendFastPath: true}))
+	_, err = strg.Compact()
+	require.Error(t, err)
+	keys, _ := manyKeys(2000)
+	checkStored(t, btree.MakePagedBTreeWithConfig(strg, btree.TConfig{}), keys, keys)
+
+	plain := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName()}
+	defer os.Remove(plain.FilePath)
+	makeManyPages(t, plain)
+	plain.CopyOnWrite = true
+	_, err = storage.MakeNodeStorage(plain)
+	require.ErrorIs(t, err, storage.ErrIncompatible)
+}
+
+// a snapshot keeps the tree of its commit, its pages are reused once it is closed
+func TestSnapshot(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), CopyOnWrite: true}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, values := manyKeys(300)
+	for i := range keys {
+		values[i] = []byte(fmt.Sprintf("old %v", i))
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	view, err := strg.Snapshot()
+	require.Empty(t, err)
+	_, err = view.AllocateRootNode()
+	require.ErrorIs(t, err, storage.ErrReadOnly)
+	require.ErrorIs(t, view.Begin(), storage.ErrReadOnly)
+	snapshotTree := btree.MakePagedBTreeWithConfig(view, btree.TConfig{})
+	require.ErrorIs(t, snapshotTree.Put([]byte("new"), []byte("new")), storage.ErrReadOnly)
+
+	updated := make([][]byte, len(values))
+	update := func(round int) int64 {
+		for i := range keys {
+			updated[i] = []byte(fmt.Sprintf("new %v", round))
+			require.Empty(t, tree.Put(keys[i], updated[i]))
+		}
+		info, err := os.Stat(config.FilePath)
+		require.Empty(t, err)
+		return info.Size()
+	}
+	info, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	// every put moves a path of the tree to new pages, the replaced ones are read by the snapshot
+	held := update(0)
+	require.Greater(t, held, 2*info.Size())
+	checkStored(t, snapshotTree, keys, values)
+	checkStored(t, tree, keys, updated)
+	require.Empty(t, view.Close())
+
+	released := update(1)
+	require.Equal(t, released, update(2))
+	require.Less(t, released-held, int64(config.PageSizeBytes)*8)
+	checkStored(t, tree, keys, updated)
+}
+
+// free pages are read from the list of the last commit instead of walking the tree
+func TestCopyOnWriteFreeList(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), CopyOnWrite: true}
+	defer os.Remove(config.FilePath)
+	makeManyPages(t, config)
+	info, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	require.Less(t, strg.Statistics().ReadCalls, uint64(10))
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(2000)
+	for _, key := range keys[:100] {
+		require.Empty(t, tree.Put(key, []byte("updated")))
+	}
+	require.Empty(t, strg.Close())
+	// replaced pages are reused after reopening
+	grown, err := os.Stat(config.FilePath)
+	require.Empty(t, err)
+	require.Less(t, grown.Size()-info.Size(), int64(config.PageSizeBytes)*8)
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		values[i] = keys[i]
+		if i < 100 {
+			values[i] = []byte("updated")
+		}
+	}
+	checkStored(t, tree, keys, values)
+}
+
+// a damaged list is rebuilt from the pages reachable from the root
+func TestCopyOnWriteDamagedFreeList(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + fileName(), CopyOnWrite: true}
+	defer os.Remove(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, _ := manyKeys(500)
+	for _, key := range keys {
+		require.Empty(t, tree.Put(key, key))
+	}
+	require.Empty(t, tree.Put(keys[0], []byte("updated")))
+	require.Empty(t, strg.Close())
+
+	data, err := os.ReadFile(config.FilePath)
+	require.Empty(t, err)
+	damaged := 0
+	for offset := 64; offset < len(data); offset += int(config.PageSizeBytes) {
+		// flags of a free list page, followed by the next page [4] and the ids count [4]
+		if data[offset] == 0x88 {
+			data[offset+9] ^= 0xff
+			damaged++
+		}
+	}
+	require.Greater(t, damaged, 0)
+	require.Empty(t, os.WriteFile(config.FilePath, data, 0644))
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree = btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	more, _ := manyKeys(1000)
+	for _, key := range more[500:] {
+		require.Empty(t, tree.Put(key, key))
+	}
+	values := append([][]byte{}, more...)
+	values[0] = []byte("updated")
+	checkStored(t, tree, more, values)
+}
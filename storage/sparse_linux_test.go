@@ -0,0 +1,17 @@
+//go:build linux
+
+package storage_test
+
+import (
+	"os"
+	"syscall"
+)
+
+// bytes of the blocks allocated to the file
+func allocatedBytes(info os.FileInfo) (int64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return stat.Blocks * 512, true
+}
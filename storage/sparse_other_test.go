@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage_test
+
+import "os"
+
+func allocatedBytes(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
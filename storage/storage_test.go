@@ -1,6 +1,8 @@
 package storage_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
 	"testing"
 	"time"
@@ -112,3 +114,187 @@ func TestThreeNodes(t *testing.T) {
 	require.Equal(t, []byte("d_value"), rrhs.Value(1))
 	require.Equal(t, []byte("e_value"), rrhs.Value(2))
 }
+
+func TestVariableCellsCount(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 0}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s1.Close()
+	root := s1.RootNode()
+	count := 0
+	for ; root.Fits(2, 1); count++ {
+		root.InsertKeyValue([]byte{'k', byte(count)}, []byte{'v'}, count)
+		require.Empty(t, root.Save())
+	}
+	// slots of 16 bytes with the key prefix
+	require.Greater(t, count, 40)
+	require.False(t, root.Fits(2, 1))
+	s1.Close()
+
+	s2, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s2.Close()
+	root = s2.RootNode()
+	require.Equal(t, count, root.KeyCount())
+	for i := 0; i < count; i++ {
+		key, err := root.KeyFull(i)
+		require.Empty(t, err)
+		require.Equal(t, []byte{'k', byte(i)}, key)
+		require.Equal(t, []byte{'v'}, root.Value(i))
+	}
+}
+
+func TestMessages(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s1.Close()
+	lhs := s1.RootNode()
+	require.Empty(t, lhs.Save())
+	root, err := s1.AllocateRootNode()
+	require.Empty(t, err)
+	root.InsertMessage(storage.TMessage{Kind: storage.MessagePut, Key: []byte("b"), Value: []byte("b_value")}, 0)
+	root.InsertMessage(storage.TMessage{Kind: storage.MessagePut, Key: []byte("a"), Value: []byte("a_value")}, 0)
+	root.InsertMessage(storage.TMessage{Kind: storage.MessageDelete, Key: []byte("c")}, 2)
+	require.Empty(t, root.Save())
+	root.RemoveMessage(1)
+	require.Empty(t, root.Save())
+	s1.Close()
+
+	s2, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s2.Close()
+	require.Equal(t, storage.FeatureMessages|storage.FeatureChecksums|storage.FeatureFreeList|storage.FeatureKeyPrefixes, s2.Config().Features)
+	root = s2.RootNode()
+	require.False(t, root.IsLeaf())
+	require.Equal(t, lhs.Id(), root.Child(0))
+	require.Equal(t, 2, root.MessageCount())
+	require.Equal(t, storage.TMessage{Kind: storage.MessagePut, Key: []byte("a"), Value: []byte("a_value")}, root.Message(0))
+	require.Equal(t, storage.TMessage{Kind: storage.MessageDelete, Key: []byte("c"), Value: []byte{}}, root.Message(1))
+}
+
+// keys sharing their prefixes, including ones padded with zeroes, are ordered by their bytes
+func TestSearch(t *testing.T) {
+	for _, mapped := range []bool{false, true} {
+		filePath := "./" + fileName()
+		defer os.Remove(filePath)
+		config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MemoryMapped: mapped}
+		strg, err := storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		keys := [][]byte{{}, {0}, []byte("a"), []byte("a\x00"), []byte("a\x00\x01"), []byte("abcdefgh"), []byte("abcdefgh1"), []byte("abcdefgh2"), []byte("abcdefgi"), []byte("b")}
+		root := strg.RootNode()
+		for i, key := range keys {
+			root.InsertKeyValue(key, key, i)
+		}
+		require.Empty(t, root.Save())
+		require.Empty(t, strg.Close())
+
+		strg, err = storage.MakeNodeStorage(config)
+		require.Empty(t, err)
+		root = strg.RootNode()
+		targets := append(append([][]byte{}, keys...), []byte("a\x00\x00"), []byte("abcdefgh0"), []byte("abcdefgh3"), []byte("c"))
+		for _, target := range targets {
+			expected := 0
+			for expected < len(keys) && bytes.Compare(keys[expected], target) == -1 {
+				expected++
+			}
+			idx, found := root.Search(target)
+			require.Equal(t, expected, idx, "target [%q]", target)
+			require.Equal(t, expected < len(keys) && bytes.Equal(keys[expected], target), found, "target [%q]", target)
+		}
+		require.Empty(t, strg.Close())
+	}
+}
+
+// the slot of a tuple holds the first bytes of its key after the cell offsets
+func TestKeyPrefixSlot(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	strg, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath})
+	require.Empty(t, err)
+	root := strg.RootNode()
+	root.InsertKeyValue([]byte("abc"), []byte("value"), 0)
+	root.InsertKeyValue([]byte("abcdefghij"), []byte("value"), 1)
+	require.Empty(t, root.Save())
+	rootId := root.Id()
+	require.Empty(t, strg.Close())
+
+	data, err := os.ReadFile(filePath)
+	require.Empty(t, err)
+	// header [5] + checksum [4], then slots of 16 bytes
+	slots := data[64+1024*rootId+9:]
+	require.Equal(t, []byte("abc\x00\x00\x00\x00\x00"), slots[8:16])
+	require.Equal(t, []byte("abcdefgh"), slots[24:32])
+}
+
+func TestHeaderConfig(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: filePath, MaxCellsCount: 5}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	created := s1.Config()
+	require.False(t, created.CreatedAt.IsZero())
+	s1.Close()
+
+	s2, err := storage.MakeNodeStorage(storage.TConfig{FilePath: filePath})
+	require.Empty(t, err)
+	require.Equal(t, created, s2.Config())
+	s2.Close()
+
+	mismatched := []storage.TConfig{
+		{PageSizeBytes: 1024, FilePath: filePath},
+		{FilePath: filePath, MaxCellsCount: 7},
+		{FilePath: filePath, ComparatorId: 3},
+	}
+	for _, config := range mismatched {
+		_, err = storage.MakeNodeStorage(config)
+		require.ErrorIs(t, err, storage.ErrIncompatible)
+	}
+}
+
+func TestForeignFile(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	require.Empty(t, os.WriteFile(filePath, []byte("definitely not a tree storage"), 0644))
+	_, err := storage.MakeNodeStorage(storage.TConfig{PageSizeBytes: 1024, FilePath: filePath})
+	require.ErrorIs(t, err, storage.ErrIncompatible)
+}
+
+func TestLayoutVersion1(t *testing.T) {
+	filePath := "./" + fileName()
+	defer os.Remove(filePath)
+	raw := binary.BigEndian.AppendUint32(nil, 1) // layout version
+	raw = binary.BigEndian.AppendUint32(raw, 0)  // root node id
+	page := make([]byte, 1024)
+	page[0] = 0xc0 // allocated leaf without cells
+	require.Empty(t, os.WriteFile(filePath, append(raw, page...), 0644))
+
+	_, err := storage.MakeNodeStorage(storage.TConfig{FilePath: filePath})
+	require.ErrorIs(t, err, storage.ErrIncompatible)
+
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: filePath, MaxCellsCount: 10}
+	s1, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	root := s1.RootNode()
+	require.True(t, root.IsLeaf())
+	root.InsertKeyValue([]byte("key"), []byte("value"), 0)
+	require.Empty(t, root.Save())
+	s1.Close()
+
+	s2, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer s2.Close()
+	require.Equal(t, []byte("value"), s2.RootNode().Value(0))
+	header := make([]byte, 4)
+	file, err := os.Open(filePath)
+	require.Empty(t, err)
+	defer file.Close()
+	_, err = file.ReadAt(header, 0)
+	require.Empty(t, err)
+	require.Equal(t, uint32(1), binary.BigEndian.Uint32(header))
+}
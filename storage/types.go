@@ -1,27 +1,136 @@
 package storage
 
 import (
+	"compress/flate"
+	"container/list"
+	"context"
+	"crypto/cipher"
+	"errors"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 const InvalidNodeId uint32 = (1 << 32) - 1
 
-const pageHeaderSizeBytes = 5   // flags [1] + cellsCount [4]
+var (
+	ErrClosed        = errors.New("storage is closed")
+	ErrCorrupted     = errors.New("storage is corrupted")
+	ErrIncompatible  = errors.New("storage is incompatible")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+	ErrReadOnly      = errors.New("storage is read-only")
+	ErrWrongKey      = errors.New("encryption key does not match the file")
+	ErrTampered      = errors.New("page failed authentication")
+	ErrStaleNode     = errors.New("node was loaded before the storage was compacted")
+)
+
+// matches ErrCorrupted with errors.Is
+type TCorruptedPageError struct {
+	PageId uint32
+	Reason string
+}
+
+const pageHeaderSizeBytes = 5   // flags [1] + cellsCount [4], followed by checksum [4] with FeatureChecksums
+const freePageSizeBytes = 5     // flags [1] + next free page id [4], the rest of a free page is ignored
+const metaPageSizeBytes = 25    // flags [1] + txn id [8] + root node id [4] + page count [4] + first free list page [4] + crc32c [4]
+const pageChecksumSizeBytes = 4 // crc32c of the header, the slots, the children and the cells, free space is not covered
+const slotSizeBytes = 8         // cell start [4] + cell end [4], followed by the key prefix [8] with FeatureKeyPrefixes
+const keyPrefixSizeBytes = 8
 const pageHeaderV2SizeBytes = 9 // flags [1] + cellsCount [4] + overflow page id [4]
-const fileHeaderSizeBytes = 8   // layout version [4] + root node id [4]
+const fileHeaderV1SizeBytes = 8 // layout version [4] + root node id [4]
+/*
+magic [4] + layout version [4] + root node id [4] + page size [4] + max cells count [4] +
+comparator id [4] + feature flags [4] + creation time [8] + first free page id [4] + key check value [8] +
+write counters reserved for nonces [8], the rest is reserved
+*/
+const fileHeaderSizeBytes = 64
+const maxShortOffset int64 = 1 << 32 // layout versions before 4 address pages with 32-bit offsets
+const fileMagic uint32 = 0x56425452  // "VBTR"
+const minCellsPerPage = 4            // only used when cells count is not fixed
+
+const ComparatorBytewise uint32 = 0 // keys are compared as byte strings, the only comparator supported by trees
 
+const (
+	FeatureMessages    uint32 = 1 << 0 // internal nodes may hold buffered messages
+	FeatureChecksums   uint32 = 1 << 1 // page headers hold a checksum, set for every new file
+	FeatureFreeList    uint32 = 1 << 2 // free pages are chained from the header, set for every new file
+	FeatureCopyOnWrite uint32 = 1 << 3 // changed nodes are written to new pages, the root id is kept in meta pages
+	FeatureCompression uint32 = 1 << 4 // pages may be compressed, set once a codec is configured
+	FeatureEncryption  uint32 = 1 << 5 // pages are encrypted, set at creation when a key provider is configured
+	FeatureKeyPrefixes uint32 = 1 << 6 // slots of tuples hold the first bytes of their keys, set for every new file
+	knownFeatures             = FeatureMessages | FeatureChecksums | FeatureFreeList | FeatureCopyOnWrite | FeatureCompression | FeatureEncryption | FeatureKeyPrefixes
+)
+
+/*
+Values of an existing file are recorded in its header: zero fields are taken from the file,
+non-zero fields have to match it.
+*/
 type TConfig struct {
 	PageSizeBytes uint32 // page size is limited with ~4GB
 	FilePath      string
-	MaxCellsCount uint32
+	MaxCellsCount uint32 // 0 means that the number of cells is limited only by the page size
+	ComparatorId  uint32
+	// not recorded in the file, 0 disables the buffer pool and every save is written immediately
+	BufferPoolBytes uint32
+	// not recorded in the file, logs every operation to FilePath + ".wal" before changing the file
+	WriteAheadLog bool
+	// size of the log which triggers a checkpoint, 0 means 1MB
+	CheckpointBytes uint32
+	// recorded in the file, commits switch the root in a meta page instead of overwriting pages,
+	// excludes the buffer pool and the write-ahead log
+	CopyOnWrite bool
+	// not recorded in the file, nodes are decoded from a read-only memory mapping of the file instead of read buffers
+	MemoryMapped bool
+	// not recorded in the file, with the buffer pool policies other than DurabilityNone require the write-ahead log
+	Durability TDurability
+	// period of DurabilityTimer, 0 means 1 second
+	SyncInterval time.Duration
+	// not recorded in the file, codec of pages written from now on, pages record the codec they were written with
+	PageCodec byte
+	// not recorded in the file, encrypts pages of a new file, an encrypted file requires the key it was created with
+	KeyProvider IKeyProvider
+	// not recorded in the file, pages are kept on the device instead of the file at FilePath,
+	// which only names the storage in errors, excludes MemoryMapped
+	Device IBlockDevice
+	// not recorded in the file, keeps the write-ahead log when Device is set
+	LogDevice IBlockDevice
+	// filled in by the storage, the values passed to MakeNodeStorage are ignored
+	Features  uint32
+	CreatedAt time.Time
 }
 
 type TStorageStatistics struct {
-	ReadCalls    uint32
-	BytesRead    uint32
-	WriteCalls   uint32
-	BytesWritten uint32
+	// loads of pages from the memory mapping are counted as reads
+	ReadCalls    uint64
+	BytesRead    uint64
+	WriteCalls   uint64
+	BytesWritten uint64
+	CacheHits    uint64
+	CacheMisses  uint64
+	Evictions    uint64
+	// appends to the write-ahead log
+	LogWriteCalls   uint64
+	LogBytesWritten uint64
+	// syncs made by the durability policy and by Close, updated atomically
+	SyncCalls uint64
+	// compressed pages whose blocks past the image were punched out of the file
+	CompressedPages uint64
+	// compressed pages whose unused bytes could not be punched out of the file, so their blocks stay allocated
+	PunchFailures uint64
+}
+
+const (
+	MessagePut    byte = 1
+	MessageDelete byte = 2
+)
+
+// pending operation buffered in an internal node, only supported when cells count is not fixed
+type TMessage struct {
+	Kind  byte
+	Key   []byte
+	Value []byte
 }
 
 type INode interface {
@@ -30,13 +139,25 @@ type INode interface {
 	Id() uint32
 	Key(id int) io.Reader
 	KeyFull(id int) ([]byte, error)
+	// index of the first key which is not less than the given one, found is set when they are equal
+	Search(key []byte) (idx int, found bool)
 	Value(id int) []byte
 	Child(idx int) uint32
 	InsertKey(key []byte, idx int)
 	InsertKeyValue(key []byte, value []byte, idx int)
 	InsertChild(childId uint32, idx int)
+	RemoveKeyValue(idx int)
 	SplitAt(idx int) (INode, error)
+	UpdateKey(idx int, key []byte)
 	UpdateValue(idx int, value []byte)
+	TupleSize(idx int) uint32
+	Fits(keySize, valueSize int) bool
+	UsedBytes() uint32
+	MessageCount() int
+	Message(idx int) TMessage
+	MessageSize(idx int) uint32
+	InsertMessage(message TMessage, idx int)
+	RemoveMessage(idx int)
 	Save() error
 }
 
@@ -44,18 +165,162 @@ type INodeStorage interface {
 	RootNode() INode
 	AllocateRootNode() (INode, error)
 	LoadNode(id uint32) (INode, error)
+	LoadNodeContext(ctx context.Context, id uint32) (INode, error)
+	FreeNode(id uint32) error
+	Compact() (int64, error)
+	// raised by every compaction, nodes loaded at an older generation can not be saved
+	Generation() uint64
+	// keeps the page of a node in the buffer pool until it is unpinned, pins are counted
+	PinNode(id uint32) error
+	UnpinNode(id uint32) error
+	// read-only view of the last commit, only supported with CopyOnWrite, the view has to be closed
+	Snapshot() (INodeStorage, error)
+	// called without holding locks after a commit, returns once the committed operations are synced
+	WaitDurable() error
 	Close() error
 	Statistics() *TStorageStatistics
+	Config() TConfig
+	// operations modifying several pages are wrapped into Begin and either Commit or Rollback
+	Begin() error
+	Commit() error
+	Rollback() error
 }
 
 type tOnDiskNodeStorage struct {
 	config        TConfig
 	rootNode      INode
-	file          *os.File
+	device        IBlockDevice
 	nextPageId    uint32
-	freePageIds   []uint32
+	freeListHead  uint32            // InvalidNodeId when there are no free pages
+	freeLinks     map[uint32]uint32 // next free page of free pages read or written so far
 	stats         *TStorageStatistics
 	layoutVersion uint32
+	undo          *tUndoLog           // only set while an operation is in progress
+	pool          *tBufferPool        // only set when BufferPoolBytes is not 0
+	wal           *tWal               // only set when WriteAheadLog is enabled
+	shadow        *tShadowPaging      // only set when CopyOnWrite is enabled
+	mapping       *tMapping           // only set when MemoryMapped is enabled
+	durability    *tDurability        // only set when Durability is not DurabilityNone
+	compressor    *flate.Writer       // reused by page writes, created by the first one
+	blockSize     int64               // of the file system holding the file, found by the first compressed page
+	decompressor  io.ReadCloser       // reused by page reads, created by the first one
+	encryption    *tEncryption        // only set for encrypted files
+	snapshotOf    *tOnDiskNodeStorage // only set for snapshots, which are read-only
+	snapshotTxnId uint64
+	generation    uint64                                // given to nodes on load, raised by every compaction
+	compacted     uint64                                // generation of the last compaction, older nodes are stale
+	writeFault    func(data []byte, offset int64) error // only set in tests
+}
+
+type tPoolEntry struct {
+	node    *tNode
+	dirty   bool
+	pins    int    // pinned entries are not evicted
+	touched bool   // by the operation in progress
+	image   []byte // page before the operation, only kept for entries which were dirty
+	element *list.Element
+}
+
+type tBufferPool struct {
+	budgetBytes uint32
+	entries     map[uint32]*tPoolEntry
+	lru         *list.List // the most recently used entries are at the front
+	touched     []*tPoolEntry
+	headerDirty bool // the header was logged by a commit and is written back along with the pages
+}
+
+type tWal struct {
+	device IBlockDevice
+	size   int64
+	synced int64 // the file is only written once the records describing the write are synced
+}
+
+// when committed operations are synced
+type TDurability uint8
+
+type tDurability struct {
+	policy    TDurability
+	target    IBlockDevice // the write-ahead log or the data file
+	mutex     sync.Mutex
+	cond      *sync.Cond // signalled once a sync ends
+	committed uint64     // operations committed so far
+	synced    uint64     // operations committed before the last sync started
+	syncing   bool
+	err       error         // failure of the timer, reported by the next commit
+	stop      chan struct{} // only set for DurabilityTimer
+	stopped   chan struct{}
+}
+
+type tEncryption struct {
+	aead       cipher.AEAD
+	checkValue []byte // recorded in the header
+	counter    uint64 // write counter of the next page
+	reserved   uint64 // counters below it are reserved in the header
+}
+
+type tMemoryDevice struct {
+	mutex sync.RWMutex
+	data  []byte
+}
+
+type tFileDevice struct {
+	file *os.File
+}
+
+type tFileKeyProvider struct {
+	path string
+}
+
+type tEnvKeyProvider struct {
+	name string
+}
+
+type tMapping struct {
+	data    []byte   // may extend past the end of the file
+	size    int64    // bytes of data within the file
+	retired [][]byte // smaller mappings of the file, nodes may still reference them
+}
+
+// a page replaced by the commit of txnId stays readable for snapshots of earlier commits
+type tReleasedPage struct {
+	id    uint32
+	txnId uint64
+}
+
+type tShadowPaging struct {
+	free        []uint32
+	released    []tReleasedPage
+	listPages   []uint32          // pages holding the free pages of the last commit
+	listed      bool              // set on open when the meta page records the first free list page
+	listHead    uint32            // first free list page of the meta page read on open
+	uncommitted map[uint32]bool   // pages taken since the last commit, written without relocation
+	dirty       map[uint32]*tNode // nodes saved by the operation in progress
+	loaded      []*tNode          // nodes loaded by the operation in progress, parents are searched among them
+	freed       []uint32          // pages freed by the operation in progress
+	mutex       sync.Mutex        // guards the fields below, which snapshots read from other goroutines
+	txnId       uint64
+	rootNodeId  uint32
+	config      TConfig
+	snapshots   map[uint64]int // open snapshots by the commit they read
+}
+
+type tUndoImage struct {
+	data   []byte
+	offset int64
+}
+
+type tUndoLog struct {
+	fileSize      int64
+	layoutVersion uint32
+	rootNodeId    uint32
+	nextPageId    uint32
+	freeListHead  uint32
+	freeLinks     map[uint32]uint32
+	features      uint32
+	images        []tUndoImage
+	saved         map[uint32]*tNode // nodes saved by the operation, only written by the commit
+	headerChanged bool              // the header is written by the commit as well
+	truncateTo    int64             // size the commit truncates the file to, 0 keeps it
 }
 
 type tCellOffsets struct {
@@ -65,6 +330,8 @@ type tCellOffsets struct {
 
 type tTuple struct {
 	offsets *tCellOffsets
+	kind    byte   // only set for messages
+	prefix  uint64 // first bytes of the key padded with zeroes, orders most keys without reading them
 	key     []byte
 	value   []byte
 }
@@ -76,7 +343,11 @@ type tNode struct {
 	tuples []*tTuple
 	// only set for internal nodes
 	children    []uint32
+	messages    []*tTuple
 	freeOffsets []tCellOffsets
+	mapped      bool // cells reference the memory mapping of the file
+	decoded     bool // read from a compressed or encrypted page, so its cells are not in place
+	generation  uint64
 }
 
 type tTupleV2 struct {
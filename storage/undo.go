@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+/******************* PUBLIC *******************/
+/*
+Starts an operation, which is either committed or rolled back as a whole. Until then
+the bytes overwritten by every write are kept in memory, so a rollback restores the file,
+the root node and the allocated pages exactly as they were at the start of the operation.
+With the write-ahead log they are also logged, so an operation interrupted by a crash is
+rolled back when the file is opened again.
+*/
+func (s *tOnDiskNodeStorage) Begin() error {
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.snapshotOf != nil {
+		return ErrReadOnly
+	}
+	if s.undo != nil {
+		return errors.New("operation is already in progress")
+	}
+	if s.wal != nil {
+		if err := s.checkpointIfNeeded(); err != nil {
+			return err
+		}
+	}
+	size, err := s.device.Size()
+	if err != nil {
+		return err
+	}
+	if s.wal != nil {
+		if err := s.logBegin(size); err != nil {
+			return err
+		}
+	}
+	s.undo = &tUndoLog{
+		fileSize:      size,
+		layoutVersion: s.layoutVersion,
+		rootNodeId:    s.rootNode.Id(),
+		nextPageId:    s.nextPageId,
+		freeListHead:  s.freeListHead,
+		freeLinks:     copyLinks(s.freeLinks),
+		features:      s.config.Features,
+	}
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) Commit() error {
+	if s.undo == nil {
+		return errors.New("no operation in progress")
+	}
+	if err := s.writeSaved(); err != nil {
+		return err
+	}
+	if s.wal != nil {
+		// the operation stays in progress, so it can still be rolled back
+		if err := s.logCommit(); err != nil {
+			return err
+		}
+	}
+	if s.shadow != nil {
+		// same as with the log, a failed commit is rolled back by the caller
+		if err := s.commitShadow(); err != nil {
+			return err
+		}
+	}
+	if s.undo.truncateTo != 0 {
+		if err := s.truncateFile(s.undo.truncateTo); err != nil {
+			return err
+		}
+	}
+	if s.durability != nil {
+		if err := s.syncCommit(); err != nil {
+			return err
+		}
+	}
+	s.undo = nil
+	if s.pool != nil {
+		s.commitPool()
+	}
+	if s.durability != nil {
+		s.durability.committedOne()
+	}
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) Rollback() error {
+	undo := s.undo
+	if undo == nil {
+		return errors.New("no operation in progress")
+	}
+	s.undo = nil
+	if s.device == nil {
+		return ErrClosed
+	}
+	if s.pool != nil {
+		if err := s.rollbackPool(); err != nil {
+			return err
+		}
+	}
+	for i := len(undo.images) - 1; i >= 0; i-- {
+		if err := s.write(undo.images[i].data, undo.images[i].offset); err != nil {
+			return fmt.Errorf("failed to restore [%v] bytes at [%v], error [%w]", len(undo.images[i].data), undo.images[i].offset, err)
+		}
+	}
+	if err := s.truncateFile(undo.fileSize); err != nil {
+		return err
+	}
+	s.layoutVersion = undo.layoutVersion
+	s.nextPageId = undo.nextPageId
+	s.freeListHead = undo.freeListHead
+	s.freeLinks = undo.freeLinks
+	s.config.Features = undo.features
+	if s.shadow != nil {
+		s.rollbackShadow(undo)
+	}
+	if s.wal != nil {
+		if err := s.appendWalRecord(walRecordAbort, nil); err != nil {
+			return err
+		}
+	}
+	root, err := s.LoadNode(undo.rootNodeId)
+	if err != nil {
+		return err
+	}
+	s.rootNode = root
+	return nil
+}
+
+/******************* PRIVATE *******************/
+/*
+Saves bytes which are about to be overwritten, writes past the initial end of the file need no undo.
+These reads are not counted in the statistics, which describe the page accesses of the tree.
+*/
+func (s *tOnDiskNodeStorage) saveBeforeImage(size int, offset int64) ([]byte, error) {
+	if s.undo == nil || offset >= s.undo.fileSize {
+		return nil, nil
+	}
+	if offset+int64(size) > s.undo.fileSize {
+		size = int(s.undo.fileSize - offset)
+	}
+	image := tUndoImage{data: make([]byte, size), offset: offset}
+	if _, err := s.device.ReadAt(image.data, offset); err != nil {
+		return nil, fmt.Errorf("failed to save [%v] bytes at [%v], error [%w]", size, offset, err)
+	}
+	s.undo.images = append(s.undo.images, image)
+	return image.data, nil
+}
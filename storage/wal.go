@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+Write-ahead log of page changes, kept next to the data file. Every operation is logged as a begin record,
+the writes it made to the file with the bytes they overwrote, the pages it left dirty in the buffer pool,
+the truncations it requested and a commit or an abort record. Each record is appended and the log is synced before the write it describes
+reaches the file, so the OS can not write a page back ahead of the record needed to undo it. The commit logs
+all pages it writes before writing the first of them, so it syncs the log once.
+
+On open the log is replayed in order: committed operations are redone, aborted and incomplete ones
+are undone, so the file ends up in the state of the last committed operation. Checkpoints write dirty
+pages back, sync the file and truncate the log.
+*/
+
+/******************* PRIVATE *******************/
+const (
+	walRecordBegin    byte = 1 // file size [8]
+	walRecordWrite    byte = 2 // offset [8] + overwritten length [4] + overwritten bytes + written bytes
+	walRecordPage     byte = 3 // offset [8] + page, for pages and the header written back later by the buffer pool
+	walRecordCommit   byte = 4
+	walRecordAbort    byte = 5
+	walRecordTruncate byte = 6 // file size [8] + file size before the truncation [8], applied after the commit record
+)
+
+const walRecordHeaderSizeBytes = 5 // kind [1] + payload length [4], followed by the payload and crc32c [4]
+const defaultCheckpointBytes = 1 << 20
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func walPath(filePath string) string {
+	return filePath + ".wal"
+}
+
+// the log device of the config or the file next to the data file
+func openWal(config TConfig) (*tWal, error) {
+	device := config.LogDevice
+	if config.Device == nil {
+		file, err := os.OpenFile(walPath(config.FilePath), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		device = &tFileDevice{file: file}
+	}
+	size, err := device.Size()
+	if err != nil {
+		device.Close()
+		return nil, err
+	}
+	return &tWal{device: device, size: size, synced: size}, nil
+}
+
+// a log left next to a new file belongs to a removed one, as does a log left on the log device
+func (s *tOnDiskNodeStorage) startWal() error {
+	if s.config.Device == nil {
+		if err := os.Remove(walPath(s.config.FilePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else if s.config.LogDevice != nil {
+		if err := s.config.LogDevice.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if !s.config.WriteAheadLog {
+		return nil
+	}
+	if err := s.device.Sync(); err != nil {
+		return err
+	}
+	wal, err := openWal(s.config)
+	if err != nil {
+		return err
+	}
+	s.wal = wal
+	return nil
+}
+
+// replays the log of the previous run, the log is removed afterwards if it is disabled now
+func (s *tOnDiskNodeStorage) recoverWal() error {
+	exists := s.config.LogDevice != nil
+	if s.config.Device == nil {
+		var err error
+		if exists, err = fileExists(walPath(s.config.FilePath)); err != nil {
+			return err
+		}
+	}
+	if !exists && !s.config.WriteAheadLog {
+		return nil
+	}
+	wal, err := openWal(s.config)
+	if err != nil {
+		return err
+	}
+	s.wal = wal
+	if err := s.replayWal(); err != nil {
+		return fmt.Errorf("failed to replay the log of [%v], error [%w]", s.config.FilePath, err)
+	}
+	if s.config.WriteAheadLog {
+		return nil
+	}
+	s.wal = nil
+	if err := wal.device.Close(); err != nil {
+		return err
+	}
+	if s.config.Device != nil {
+		return nil
+	}
+	return os.Remove(walPath(s.config.FilePath))
+}
+
+func (s *tOnDiskNodeStorage) closeDevices() {
+	if s.wal != nil {
+		s.wal.device.Close()
+	}
+	s.device.Close()
+}
+
+func (s *tOnDiskNodeStorage) appendWalRecord(kind byte, payload []byte) error {
+	// lengths of records are 32-bit, so a single write of 4GiB or more fails with the log
+	if int64(len(payload)) >= maxShortOffset {
+		return fmt.Errorf("log record of [%v] bytes is too large", len(payload))
+	}
+	record := make([]byte, 0, walRecordHeaderSizeBytes+len(payload)+4)
+	record = append(record, kind)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(payload)))
+	record = append(record, payload...)
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(record, crc32cTable))
+	if s.writeFault != nil {
+		if err := s.writeFault(record, s.wal.size); err != nil {
+			return err
+		}
+	}
+	if _, err := s.wal.device.WriteAt(record, s.wal.size); err != nil {
+		return fmt.Errorf("failed to append to the log, error [%w]", err)
+	}
+	s.wal.size += int64(len(record))
+	s.stats.LogWriteCalls += 1
+	s.stats.LogBytesWritten += uint64(len(record))
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) logBegin(fileSize int64) error {
+	return s.appendWalRecord(walRecordBegin, binary.BigEndian.AppendUint64(nil, uint64(fileSize)))
+}
+
+func (s *tOnDiskNodeStorage) logWrite(offset int64, before, after []byte) error {
+	payload := make([]byte, 0, 12+len(before)+len(after))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(before)))
+	payload = append(payload, before...)
+	payload = append(payload, after...)
+	return s.appendWalRecord(walRecordWrite, payload)
+}
+
+func (s *tOnDiskNodeStorage) logTruncate(size, sizeBefore int64) error {
+	return s.appendWalRecord(walRecordTruncate, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, uint64(size)), uint64(sizeBefore)))
+}
+
+// logs pages the operation left dirty in the buffer pool and the header it changed, then the commit record
+func (s *tOnDiskNodeStorage) logCommit() error {
+	if s.pool != nil {
+		for _, entry := range s.pool.touched {
+			// pages of freed and relocated nodes are no longer in the pool
+			if !entry.dirty || s.pool.entries[entry.node.id] != entry {
+				continue
+			}
+			page, _, err := s.physicalPage(entry.node.id, entry.node.encodePage())
+			if err != nil {
+				return err
+			}
+			payload := binary.BigEndian.AppendUint64(nil, uint64(s.pageOffset(entry.node.id)))
+			if err := s.appendWalRecord(walRecordPage, append(payload, page...)); err != nil {
+				return err
+			}
+		}
+		if s.undo.headerChanged {
+			if err := s.appendWalRecord(walRecordPage, append(binary.BigEndian.AppendUint64(nil, 0), s.encodeHeader()...)); err != nil {
+				return err
+			}
+			s.pool.headerDirty = true
+		}
+	}
+	return s.appendWalRecord(walRecordCommit, nil)
+}
+
+// changes outside of an operation are logged as an operation of their own
+func (s *tOnDiskNodeStorage) autocommit(change func() error) error {
+	if err := s.Begin(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		if rollbackErr := s.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w, rollback failed with error [%v]", err, rollbackErr)
+		}
+		return err
+	}
+	return s.Commit()
+}
+
+func (s *tOnDiskNodeStorage) checkpointIfNeeded() error {
+	limit := int64(s.config.CheckpointBytes)
+	if limit == 0 {
+		limit = defaultCheckpointBytes
+	}
+	if s.wal.size < limit {
+		return nil
+	}
+	return s.checkpoint()
+}
+
+func (s *tOnDiskNodeStorage) checkpoint() error {
+	if s.pool != nil {
+		if err := s.flushPool(); err != nil {
+			return err
+		}
+	}
+	if err := s.device.Sync(); err != nil {
+		return err
+	}
+	if err := s.wal.device.Truncate(0); err != nil {
+		return err
+	}
+	s.wal.size = 0
+	s.wal.synced = 0
+	return nil
+}
+
+// called before every write to the file
+func (s *tOnDiskNodeStorage) syncWal() error {
+	if s.wal == nil || s.wal.synced == s.wal.size {
+		return nil
+	}
+	if err := syncDevice(s.wal.device, s.stats); err != nil {
+		return fmt.Errorf("failed to sync the log, error [%w]", err)
+	}
+	s.wal.synced = s.wal.size
+	return nil
+}
+
+type tWalRecord struct {
+	kind    byte
+	payload []byte
+}
+
+type tWalOperation struct {
+	fileSize int64
+	records  []tWalRecord
+}
+
+// applies the log to the file, then truncates the log
+func (s *tOnDiskNodeStorage) replayWal() error {
+	records, err := readWalRecords(s.wal.device)
+	if err != nil {
+		return err
+	}
+	var operation *tWalOperation
+	for _, record := range records {
+		switch record.kind {
+		case walRecordBegin:
+			if operation != nil {
+				if err := s.undoWalOperation(operation); err != nil {
+					return err
+				}
+			}
+			operation = &tWalOperation{fileSize: int64(binary.BigEndian.Uint64(record.payload))}
+		case walRecordWrite, walRecordPage, walRecordTruncate:
+			if operation == nil {
+				return fmt.Errorf("%w: log record [%v] outside of an operation", ErrCorrupted, record.kind)
+			}
+			operation.records = append(operation.records, record)
+		case walRecordCommit, walRecordAbort:
+			if operation == nil {
+				return fmt.Errorf("%w: log record [%v] outside of an operation", ErrCorrupted, record.kind)
+			}
+			if record.kind == walRecordCommit {
+				err = s.redoWalOperation(operation)
+			} else {
+				err = s.undoWalOperation(operation)
+			}
+			if err != nil {
+				return err
+			}
+			operation = nil
+		default:
+			return fmt.Errorf("%w: unknown log record [%v]", ErrCorrupted, record.kind)
+		}
+	}
+	if operation != nil {
+		if err := s.undoWalOperation(operation); err != nil {
+			return err
+		}
+	}
+	return s.checkpoint()
+}
+
+func (s *tOnDiskNodeStorage) redoWalOperation(operation *tWalOperation) error {
+	for _, record := range operation.records {
+		offset := int64(binary.BigEndian.Uint64(record.payload))
+		if record.kind == walRecordTruncate {
+			if err := s.truncateFile(offset); err != nil {
+				return err
+			}
+			continue
+		}
+		data := record.payload[8:]
+		if record.kind == walRecordWrite {
+			data = data[4+binary.BigEndian.Uint32(data):]
+		}
+		if err := s.write(data, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *tOnDiskNodeStorage) undoWalOperation(operation *tWalOperation) error {
+	for i := len(operation.records) - 1; i >= 0; i-- {
+		record := operation.records[i]
+		offset := int64(binary.BigEndian.Uint64(record.payload))
+		var before []byte
+		switch record.kind {
+		case walRecordWrite:
+			before = record.payload[12 : 12+binary.BigEndian.Uint32(record.payload[8:])]
+		default:
+			// truncations are applied only after the commit record
+			continue
+		}
+		if err := s.write(before, offset); err != nil {
+			return err
+		}
+	}
+	return s.truncateFile(operation.fileSize)
+}
+
+// stops at the first incomplete or damaged record, which was being appended during a crash
+func readWalRecords(device IBlockDevice) ([]tWalRecord, error) {
+	data, err := io.ReadAll(io.NewSectionReader(device, 0, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	records := []tWalRecord{}
+	for len(data) >= walRecordHeaderSizeBytes+4 {
+		payloadLen := binary.BigEndian.Uint32(data[1:])
+		recordLen := walRecordHeaderSizeBytes + int(payloadLen) + 4
+		if payloadLen > uint32(len(data)) || recordLen > len(data) {
+			break
+		}
+		checksum := binary.BigEndian.Uint32(data[recordLen-4:])
+		if crc32.Checksum(data[:recordLen-4], crc32cTable) != checksum {
+			break
+		}
+		records = append(records, tWalRecord{kind: data[0], payload: data[walRecordHeaderSizeBytes : recordLen-4]})
+		data = data[recordLen:]
+	}
+	return records, nil
+}
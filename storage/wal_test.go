@@ -0,0 +1,163 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladem/btree/btree"
+	"github.com/vladem/btree/storage"
+	"github.com/vladem/btree/util"
+)
+
+/*
+Simulates a crash at the k-th write of a put for every k: the data file and the log are copied
+as they are before the failing write. Opening the copy must recover every committed put and
+must not show the interrupted one.
+*/
+func checkCrashRecovery(t *testing.T, config storage.TConfig, makeTree tTreeFactory) {
+	crashed := "./" + util.TimeBasedFileName()
+	defer removeWithLog(config.FilePath)
+	defer removeWithLog(crashed)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := makeTree(strg)
+	keys, values := manyKeys(120)
+	util.ShuffleSliceBytes(keys)
+	for i := range keys {
+		values[i] = []byte(fmt.Sprintf("value of %s", keys[i]))
+	}
+	stored := 0
+	for ; stored < 100; stored++ {
+		require.Empty(t, tree.Put(keys[stored], values[stored]))
+	}
+	for ; stored < len(keys); stored++ {
+		for failAt := 1; ; failAt++ {
+			writes := 0
+			storage.SetWriteFault(strg, func(data []byte, offset int64) error {
+				writes++
+				if writes == failAt {
+					require.Empty(t, copyWithLog(config.FilePath, crashed))
+					return errInjected
+				}
+				return nil
+			})
+			err = tree.Put(keys[stored], values[stored])
+			storage.SetWriteFault(strg, nil)
+			if err == nil {
+				break
+			}
+			require.ErrorIs(t, err, errInjected)
+
+			recoveredConfig := config
+			recoveredConfig.FilePath = crashed
+			recovered, err := storage.MakeNodeStorage(recoveredConfig)
+			require.Empty(t, err, "put of [%s] crashed at write [%v]", keys[stored], failAt)
+			recoveredTree := makeTree(recovered)
+			checkStored(t, recoveredTree, keys[:stored], values[:stored])
+			_, err = recoveredTree.Get(keys[stored])
+			require.ErrorIs(t, err, btree.ErrNotFound)
+			require.Empty(t, recovered.Close())
+			removeWithLog(crashed)
+		}
+	}
+	checkStored(t, tree, keys, values)
+	require.Empty(t, strg.Close())
+
+	strg, err = storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	checkStored(t, makeTree(strg), keys, values)
+}
+
+// the log is copied if there is one
+func copyWithLog(from, to string) error {
+	for _, suffix := range []string{"", ".wal"} {
+		data, err := os.ReadFile(from + suffix)
+		if suffix != "" && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(to+suffix, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeWithLog(filePath string) {
+	os.Remove(filePath)
+	os.Remove(filePath + ".wal")
+}
+
+func TestCrashRecoveryFixedCells(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 1024, FilePath: "./" + util.TimeBasedFileName(), MaxCellsCount: 5, WriteAheadLog: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTree(strg, 5)
+	})
+}
+
+func TestCrashRecoveryBuffered(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 512, FilePath: "./" + util.TimeBasedFileName(), WriteAheadLog: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakeBufferedBTree(strg)
+	})
+}
+
+func TestCrashRecoveryBufferPool(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + util.TimeBasedFileName(), BufferPoolBytes: 256 * 8, WriteAheadLog: true}
+	checkCrashRecovery(t, config, func(strg storage.INodeStorage) btree.IBTree {
+		return btree.MakePagedBTreeWithConfig(strg, btree.TConfig{Redistribute: true, AppendFastPath: true})
+	})
+}
+
+func TestWalCheckpoint(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + util.TimeBasedFileName(), WriteAheadLog: true, CheckpointBytes: 8 * 1024}
+	defer removeWithLog(config.FilePath)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, values := manyKeys(500)
+	for i := range keys {
+		values[i] = keys[i]
+		require.Empty(t, tree.Put(keys[i], values[i]))
+		info, err := os.Stat(config.FilePath + ".wal")
+		require.Empty(t, err)
+		// a single put logs a few pages and at most one batch of 100 newly allocated pages
+		require.Less(t, info.Size(), int64(config.CheckpointBytes+(100+8)*config.PageSizeBytes))
+	}
+	require.Greater(t, strg.Statistics().LogWriteCalls, uint64(500))
+	require.Empty(t, strg.Close())
+	info, err := os.Stat(config.FilePath + ".wal")
+	require.Empty(t, err)
+	require.Equal(t, int64(0), info.Size())
+}
+
+// a log left by a crash is replayed and removed even when it is disabled on open
+func TestWalReplayWithLogDisabled(t *testing.T) {
+	config := storage.TConfig{PageSizeBytes: 256, FilePath: "./" + util.TimeBasedFileName(), BufferPoolBytes: 256 * 64, WriteAheadLog: true}
+	crashed := "./" + util.TimeBasedFileName()
+	defer removeWithLog(config.FilePath)
+	defer removeWithLog(crashed)
+	strg, err := storage.MakeNodeStorage(config)
+	require.Empty(t, err)
+	defer strg.Close()
+	tree := btree.MakePagedBTreeWithConfig(strg, btree.TConfig{})
+	keys, values := manyKeys(200)
+	for i := range keys {
+		values[i] = keys[i]
+		require.Empty(t, tree.Put(keys[i], values[i]))
+	}
+	require.Empty(t, copyWithLog(config.FilePath, crashed))
+
+	recovered, err := storage.MakeNodeStorage(storage.TConfig{FilePath: crashed})
+	require.Empty(t, err)
+	defer recovered.Close()
+	checkStored(t, btree.MakePagedBTreeWithConfig(recovered, btree.TConfig{}), keys, values)
+	_, err = os.Stat(crashed + ".wal")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
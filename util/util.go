@@ -10,6 +10,15 @@ import (
 
 func PrintStats(strg storage.INodeStorage) {
 	fmt.Printf("write, calls: [%v], bytes: [%v]\nread, calls: [%v], bytes: [%v]\n", strg.Statistics().WriteCalls, strg.Statistics().BytesWritten, strg.Statistics().ReadCalls, strg.Statistics().BytesRead)
+	if strg.Config().BufferPoolBytes != 0 {
+		fmt.Printf("pool, hits: [%v], misses: [%v], evictions: [%v]\n", strg.Statistics().CacheHits, strg.Statistics().CacheMisses, strg.Statistics().Evictions)
+	}
+	if strg.Config().WriteAheadLog {
+		fmt.Printf("log, calls: [%v], bytes: [%v]\n", strg.Statistics().LogWriteCalls, strg.Statistics().LogBytesWritten)
+	}
+	if strg.Config().Durability != storage.DurabilityNone {
+		fmt.Printf("sync, calls: [%v]\n", strg.Statistics().SyncCalls)
+	}
 }
 
 /*